@@ -0,0 +1,87 @@
+package retrying
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Breaker is a circuit breaker consulted before each attempt
+// Allow report whether an attempt may be made, Record is called with the outcome of each attempt made
+type Breaker interface {
+	Allow() bool
+	Record(success bool)
+}
+
+// Breaker set circuit breaker of attempts, retrying stops with ErrCircuitOpen once it refuses an attempt
+func (r *Retryable) Breaker(b Breaker) *Retryable {
+	if b == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: breaker must not be nil", ErrInvalidBreaker))
+		return r
+	}
+	r.breaker = b
+	return r
+}
+
+// CountBreaker opens after a number of consecutive failures
+// once cooldown passes a single trial attempt is allowed, its success closes the breaker again
+type CountBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	clock     Clock
+}
+
+// NewCountBreaker create a closed breaker opening after threshold consecutive failures for cooldown
+func NewCountBreaker(threshold int, cooldown time.Duration) *CountBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CountBreaker{threshold: threshold, cooldown: cooldown, clock: realClock{}}
+}
+
+// Clock set the source of time measuring the cooldown, e.g. a fake clock in tests, nil restores the real clock
+func (b *CountBreaker) Clock(c Clock) *CountBreaker {
+	if c == nil {
+		c = realClock{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clock = c
+	return b
+}
+
+// Allow implements Breaker
+func (b *CountBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	// half open, only one trial at a time
+	if b.trial || b.clock.Now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// Record implements Breaker
+func (b *CountBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.clock.Now()
+	}
+}
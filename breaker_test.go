@@ -0,0 +1,105 @@
+package retrying
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/yumimobi/retrying/retryingtest"
+)
+
+func TestBreaker(t *testing.T) {
+	r := New().Breaker(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidBreaker) {
+		t.Errorf("error should be %v but get %v", ErrInvalidBreaker, r.errors[0])
+	}
+
+	// the breaker opens after 3 failures and blocks the rest attempts
+	b := NewCountBreaker(3, time.Minute)
+	c1 := 0
+	r1 := New().MaxAttemptTimes(5).Breaker(b).Function(func() error {
+		c1++
+		return fmt.Errorf("")
+	})
+	err := r1.Try()
+	if !errors.Is(err, ErrCircuitOpen) || c1 != 3 {
+		t.Errorf("error should be %v after 3 calls but get %v after %v calls", ErrCircuitOpen, err, c1)
+	}
+
+	// other retryables sharing the breaker are blocked too
+	c2 := 0
+	r2 := New().MaxAttemptTimes(5).Breaker(b).Function(func() error {
+		c2++
+		return nil
+	})
+	if err := r2.Try(); !errors.Is(err, ErrCircuitOpen) || c2 != 0 {
+		t.Errorf("error should be %v without calls but get %v after %v calls", ErrCircuitOpen, err, c2)
+	}
+}
+
+func TestBreakerTrialTimeout(t *testing.T) {
+	b := NewCountBreaker(1, time.Millisecond)
+	b.Record(false)
+	time.Sleep(time.Millisecond * 2)
+
+	// the half open trial times out
+	err := New().MaxDelay(time.Millisecond * 10).Breaker(b).DrainOnTimeout(true).FunctionContext(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}).Try()
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("error should be %v but get %v", ErrTimeout, err)
+	}
+
+	// the timed out trial is recorded as a failure, so another trial follows the cooldown
+	time.Sleep(time.Millisecond * 2)
+	c := 0
+	if err := New().Breaker(b).Func(func() error {
+		c++
+		return nil
+	}).Try(); err != nil || c != 1 {
+		t.Errorf("error should be nil after 1 call but get %v after %v calls", err, c)
+	}
+	if !b.Allow() {
+		t.Error("breaker should be closed after a successful trial")
+	}
+}
+
+func TestCountBreaker(t *testing.T) {
+	clock := retryingtest.NewFakeClock(time.Now())
+	b := NewCountBreaker(2, time.Second).Clock(clock)
+
+	b.Record(false)
+	if !b.Allow() {
+		t.Error("breaker should be closed after 1 failure")
+	}
+	b.Record(false)
+	if b.Allow() {
+		t.Error("breaker should be open after 2 failures")
+	}
+
+	// a failed trial opens it again
+	clock.Advance(time.Second)
+	if !b.Allow() || b.Allow() {
+		t.Error("breaker should allow a single trial after cooldown")
+	}
+	b.Record(false)
+	if b.Allow() {
+		t.Error("breaker should be open after a failed trial")
+	}
+
+	// a successful trial closes it
+	clock.Advance(time.Second)
+	if !b.Allow() {
+		t.Error("breaker should allow a trial after cooldown")
+	}
+	b.Record(true)
+	if !b.Allow() || !b.Allow() {
+		t.Error("breaker should be closed after a successful trial")
+	}
+}
@@ -0,0 +1,70 @@
+package retrying
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Budget is a token bucket shared by retryables to limit retries against a backend
+// each retry takes a token, the first attempt of a try is free
+type Budget struct {
+	mu       sync.Mutex
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+	clock    Clock
+}
+
+// NewBudget create a full budget holding at most capacity tokens and refilling rate tokens per second
+func NewBudget(capacity int, rate float64) *Budget {
+	return &Budget{
+		capacity: float64(capacity),
+		rate:     rate,
+		tokens:   float64(capacity),
+		clock:    realClock{},
+	}
+}
+
+// Clock set the source of time measuring refills, e.g. a fake clock in tests, nil restores the real clock
+func (b *Budget) Clock(c Clock) *Budget {
+	if c == nil {
+		c = realClock{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clock = c
+	return b
+}
+
+// take a token, false if the budget is exhausted
+func (b *Budget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Budget set budget retries are taken from, retrying stops when it is exhausted
+func (r *Retryable) Budget(b *Budget) *Retryable {
+	if b == nil || b.capacity < 1 || b.rate < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: budget must not be nil and needs positive capacity and non-negative rate", ErrInvalidBudget))
+		return r
+	}
+	r.budget = b
+	return r
+}
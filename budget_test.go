@@ -0,0 +1,90 @@
+package retrying
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yumimobi/retrying/retryingtest"
+)
+
+func TestBudget(t *testing.T) {
+	for _, b := range []*Budget{nil, NewBudget(0, 1), NewBudget(1, -1)} {
+		r := New().Budget(b)
+		if len(r.errors) != 1 {
+			t.Error("number of errors should be 1")
+		}
+		if !errors.Is(r.errors[0], ErrInvalidBudget) {
+			t.Errorf("error should be %v but get %v", ErrInvalidBudget, r.errors[0])
+		}
+	}
+
+	// retryables sharing a budget stop once it is exhausted
+	b := NewBudget(3, 0)
+	c1 := 0
+	r1 := New().MaxAttemptTimes(3).Budget(b).Function(func() error {
+		c1++
+		return fmt.Errorf("")
+	})
+	if err := r1.Try(); err == nil || c1 != 3 {
+		t.Errorf("function should fail 3 times but get %v calls with %v", c1, err)
+	}
+	c2 := 0
+	r2 := New().MaxAttemptTimes(3).Budget(b).Function(func() error {
+		c2++
+		return fmt.Errorf("")
+	})
+	if err := r2.Try(); err == nil || c2 != 2 {
+		t.Errorf("function should fail 2 times but get %v calls with %v", c2, err)
+	}
+	if err := r2.Try(); err == nil || c2 != 3 {
+		t.Errorf("function should fail once but get %v calls with %v", c2, err)
+	}
+}
+
+func TestBudgetConcurrent(t *testing.T) {
+	b := NewBudget(10, 0)
+
+	var calls int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			New().MaxAttemptTimes(5).Budget(b).Function(func() error {
+				atomic.AddInt64(&calls, 1)
+				return fmt.Errorf("")
+			}).Try()
+		}()
+	}
+	wg.Wait()
+
+	// every first attempt is free and 10 retries are taken from the budget
+	if n := atomic.LoadInt64(&calls); n != 30 {
+		t.Errorf("number of calls should be 30 but get %v", n)
+	}
+}
+
+func TestBudgetRefill(t *testing.T) {
+	clock := retryingtest.NewFakeClock(time.Now())
+	b := NewBudget(2, 1).Clock(clock)
+
+	if !b.take() || !b.take() || b.take() {
+		t.Error("budget should hold 2 tokens")
+	}
+	clock.Advance(time.Millisecond * 500)
+	if b.take() {
+		t.Error("budget should not refill a token in 500ms")
+	}
+	clock.Advance(time.Millisecond * 500)
+	if !b.take() {
+		t.Error("budget should refill a token in 1s")
+	}
+	clock.Advance(time.Minute)
+	if !b.take() || !b.take() || b.take() {
+		t.Error("budget should refill up to its capacity")
+	}
+}
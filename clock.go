@@ -0,0 +1,54 @@
+package retrying
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by retry loops
+// it can be replaced by a fake clock to drive MaxElapsedTime, MaxDelay and waits in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock use package time
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { sleep(d) }
+
+// Clock set the source of time, the real clock is used by default
+func (r *Retryable) Clock(c Clock) *Retryable {
+	if c == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: clock must not be nil", ErrInvalidClock))
+		return r
+	}
+	r.clock = c
+	return r
+}
+
+// withDeadline is like context.WithTimeout but the timeout is measured by clock
+// the goroutine watching clock is tracked by wg and exits once the returned ctx is done
+func withDeadline(parent context.Context, clock Clock, timeout time.Duration, wg *sync.WaitGroup) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(realClock); ok {
+		return context.WithTimeout(parent, timeout)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	expired := clock.After(timeout)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-expired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
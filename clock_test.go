@@ -0,0 +1,94 @@
+package retrying
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/yumimobi/retrying/retryingtest"
+)
+
+func TestClock(t *testing.T) {
+	r := New().Clock(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidClock) {
+		t.Errorf("error should be %v but get %v", ErrInvalidClock, r.errors[0])
+	}
+}
+
+func TestClockWait(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := retryingtest.NewFakeClock(start)
+
+	var starts []time.Time
+	r := New().MaxAttemptTimes(3).
+		WaitFixed(time.Second).
+		Clock(clock).
+		OnRetry(func(a Attempt) {
+			starts = append(starts, a.Start)
+		}).
+		Function(func() error {
+			return fmt.Errorf("")
+		})
+
+	done := make(chan error, 1)
+	go func() { done <- r.Try() }()
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+	}
+	if err := <-done; err == nil {
+		t.Error("error should not be nil")
+	}
+	if len(starts) != 2 || !starts[0].Equal(start) || !starts[1].Equal(start.Add(time.Second)) {
+		t.Errorf("attempts should start at virtual time but get %v", starts)
+	}
+}
+
+func TestClockMaxElapsedTime(t *testing.T) {
+	clock := retryingtest.NewFakeClock(time.Now())
+
+	c1 := 0
+	r := New().MaxAttemptTimes(100).
+		MaxElapsedTime(time.Second * 2).
+		WaitFixed(time.Second).
+		Clock(clock).
+		Function(func() error {
+			c1++
+			return fmt.Errorf("")
+		})
+
+	done := make(chan error, 1)
+	go func() { done <- r.Try() }()
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+	}
+	if err := <-done; err == nil || c1 != 2 {
+		t.Errorf("function should fail 2 times but get %v calls with %v", c1, err)
+	}
+}
+
+func TestClockMaxDelay(t *testing.T) {
+	clock := retryingtest.NewFakeClock(time.Now())
+
+	r := New().MaxAttemptTimes(3).
+		MaxDelay(time.Second * 5).
+		WaitFixed(time.Second * 10).
+		Clock(clock).
+		Function(func() error {
+			return fmt.Errorf("")
+		})
+
+	done := make(chan error, 1)
+	go func() { done <- r.Try() }()
+	// max delay and the first wait are pending
+	clock.BlockUntil(2)
+	clock.Advance(time.Second * 5)
+	if err := <-done; !errors.Is(err, ErrTimeout) || !r.TimedOut() {
+		t.Errorf("error should be %v but get %v", ErrTimeout, err)
+	}
+}
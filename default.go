@@ -0,0 +1,41 @@
+package retrying
+
+import (
+	"sync"
+	"time"
+)
+
+// built-in default policy used when no default is registered
+const (
+	builtinDefaultMaxAttemptTimes = 3
+	builtinDefaultWaitFixed       = time.Millisecond * 100
+)
+
+var (
+	defaultMu sync.RWMutex
+	defaultR  *Retryable
+)
+
+// SetDefault register a copy of r as the application-wide default policy
+// nil restores the built-in default of 3 attempts with 100ms fixed wait
+func SetDefault(r *Retryable) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if r == nil {
+		defaultR = nil
+		return
+	}
+	defaultR = r.Clone()
+}
+
+// Default return a copy of the registered default policy, or the built-in one if none is registered
+func Default() *Retryable {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	if defaultR == nil {
+		return New().MaxAttemptTimes(builtinDefaultMaxAttemptTimes).WaitFixed(builtinDefaultWaitFixed)
+	}
+	return defaultR.Clone()
+}
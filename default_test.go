@@ -0,0 +1,52 @@
+package retrying
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefault(t *testing.T) {
+	defer SetDefault(nil)
+
+	// built-in default
+	r1 := Default()
+	if r1.maxAttemptTimes != builtinDefaultMaxAttemptTimes || r1.waitFixed != builtinDefaultWaitFixed {
+		t.Errorf("default should be built-in but get %v attempts with %v wait", r1.maxAttemptTimes, r1.waitFixed)
+	}
+
+	// registered default
+	tmpl := New().MaxAttemptTimes(5)
+	SetDefault(tmpl)
+	tmpl.MaxAttemptTimes(10)
+	r2 := Default()
+	if r2.maxAttemptTimes != 5 {
+		t.Errorf("max attempt times should be 5 but get %v", r2.maxAttemptTimes)
+	}
+
+	// callers can not mutate the registered default
+	r2.MaxAttemptTimes(-1)
+	if r3 := Default(); r3.maxAttemptTimes != 5 || len(r3.errors) != 0 {
+		t.Errorf("default should not be mutated but get %v attempts with %v", r3.maxAttemptTimes, r3.errors)
+	}
+
+	// concurrent use
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			SetDefault(New().MaxAttemptTimes(2).WaitFixed(time.Millisecond))
+			calls := 0
+			Default().Function(func() error {
+				calls++
+				return fmt.Errorf("")
+			}).Try()
+			if calls != 2 {
+				t.Errorf("function should be called 2 times but get %v", calls)
+			}
+		}()
+	}
+	wg.Wait()
+}
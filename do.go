@@ -0,0 +1,133 @@
+package retrying
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errRetryOnResult marks an attempt whose result matches the RetryOnResult predicate
+var errRetryOnResult = fmt.Errorf("result matches retry predicate")
+
+// DoOption set options of a typed Do call
+type DoOption[T any] func(*doOptions[T])
+
+type doOptions[T any] struct {
+	retryOnResult func(T) bool
+}
+
+// RetryOnResult retry while pred returns true for the result even though no error is returned
+func RetryOnResult[T any](pred func(T) bool) DoOption[T] {
+	return func(o *doOptions[T]) {
+		o.retryOnResult = pred
+	}
+}
+
+// Do call fn with retry options of r and return its last result
+// the last result and nil error are returned if the predicate of RetryOnResult
+// still matches when MaxAttemptTimes is exhausted, any other end of retrying returns its error
+func Do[T any](r *Retryable, fn func() (T, error), opts ...DoOption[T]) (T, error) {
+	return DoContext(context.Background(), r, fn, opts...)
+}
+
+// DoContext is like Do but stop retrying once ctx is done
+func DoContext[T any](ctx context.Context, r *Retryable, fn func() (T, error), opts ...DoOption[T]) (T, error) {
+	o := &doOptions[T]{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var (
+		mu      sync.Mutex
+		result  T
+		matched bool
+	)
+	st := r.newState()
+	_, err := r.run(ctx, st, r.wrapRecoverFunc(func(context.Context) error {
+		mu.Lock()
+		matched = false
+		mu.Unlock()
+
+		res, err := fn()
+
+		mu.Lock()
+		defer mu.Unlock()
+		result = res
+		if err != nil {
+			return err
+		}
+		if o.retryOnResult != nil && o.retryOnResult(res) {
+			matched = true
+			return errRetryOnResult
+		}
+		return nil
+	}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil && (!matched || !st.exhausted || errors.Is(err, ErrStopped)) {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
+
+// DoFound call fn with retry options of r until it reports the value found and return the value
+// it fits lookups like func() (T, bool, error) where a miss is transient, attempts missing the value fail with ErrNotFound
+func DoFound[T any](r *Retryable, fn func() (T, bool, error)) (T, error) {
+	return Do(r, func() (T, error) {
+		v, found, err := fn()
+		if err == nil && !found {
+			return v, ErrNotFound
+		}
+		return v, err
+	})
+}
+
+// Concurrency set max number of items retried at once by batch helpers like DoAll, so that at most n attempts
+// are in flight and n goroutines run, an item keeps its slot while waiting between attempts,
+// all items are retried concurrently by default
+func (r *Retryable) Concurrency(n int) *Retryable {
+	if n <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive integer", ErrInvalidConcurrency))
+		return r
+	}
+	r.concurrency = n
+	return r
+}
+
+// DoAll retry fn for each of items with the policy configured by opts
+// results and errors are aligned by index with items
+func DoAll[T, R any](items []T, fn func(T) (R, error), opts ...Option) ([]R, []error) {
+	r := newWithOptions(opts...)
+	results := make([]R, len(items))
+	errs := make([]error, len(items))
+
+	limit := len(items)
+	if r.concurrency > 0 && r.concurrency < limit {
+		limit = r.concurrency
+	}
+
+	// a pool of limit workers retries items one at a time, so goroutines are bounded like attempts
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < limit; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i], errs[i] = Do(r, func() (R, error) {
+					return fn(items[i])
+				})
+			}
+		}()
+	}
+	for i := range items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results, errs
+}
@@ -0,0 +1,250 @@
+package retrying
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	// succeed after two errors
+	c1 := 0
+	v, err := Do(New().MaxAttemptTimes(5), func() (int, error) {
+		c1++
+		if c1 < 3 {
+			return 0, fmt.Errorf("")
+		}
+		return c1, nil
+	})
+	if err != nil || v != 3 {
+		t.Errorf("result should be 3 and nil but get %v and %v", v, err)
+	}
+
+	// fail on all attempts
+	if v, err := Do(New().MaxAttemptTimes(2), func() (int, error) {
+		return 1, fmt.Errorf("")
+	}); err == nil || v != 0 {
+		t.Errorf("result should be 0 and error but get %v and %v", v, err)
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c1 := 0
+	_, err := DoContext(ctx, New().MaxAttemptTimes(5), func() (int, error) {
+		c1++
+		cancel()
+		return 0, fmt.Errorf("")
+	})
+	if !errors.Is(err, context.Canceled) || c1 != 1 {
+		t.Errorf("error should be canceled after 1 call but get %v after %v calls", err, c1)
+	}
+}
+
+func TestDoFound(t *testing.T) {
+	// found after two misses
+	c1 := 0
+	v, err := DoFound(New().MaxAttemptTimes(5), func() (string, bool, error) {
+		c1++
+		if c1 < 3 {
+			return "", false, nil
+		}
+		return "v", true, nil
+	})
+	if err != nil || v != "v" || c1 != 3 {
+		t.Errorf("result should be v and nil after 3 calls but get %v and %v after %v calls", v, err, c1)
+	}
+
+	// missed on all attempts
+	if v, err := DoFound(New().MaxAttemptTimes(2), func() (string, bool, error) {
+		return "stale", false, nil
+	}); !errors.Is(err, ErrNotFound) || v != "" {
+		t.Errorf("result should be empty and %v but get %v and %v", ErrNotFound, v, err)
+	}
+
+	// errors are retried like misses
+	c2 := 0
+	errLookup := errors.New("lookup")
+	if _, err := DoFound(New().MaxAttemptTimes(2), func() (int, bool, error) {
+		c2++
+		return 0, true, errLookup
+	}); !errors.Is(err, errLookup) || errors.Is(err, ErrNotFound) || c2 != 2 {
+		t.Errorf("error should be %v after 2 calls but get %v after %v calls", errLookup, err, c2)
+	}
+}
+
+func TestRetryOnResult(t *testing.T) {
+	pending := func(status string) bool { return status == "pending" }
+
+	// retry while pending
+	c1 := 0
+	v, err := Do(New().MaxAttemptTimes(5), func() (string, error) {
+		c1++
+		if c1 < 3 {
+			return "pending", nil
+		}
+		return "done", nil
+	}, RetryOnResult(pending))
+	if err != nil || v != "done" || c1 != 3 {
+		t.Errorf("result should be done after 3 calls but get %v and %v after %v calls", v, err, c1)
+	}
+
+	// pending on all attempts
+	c2 := 0
+	v, err = Do(New().MaxAttemptTimes(3), func() (string, error) {
+		c2++
+		return "pending", nil
+	}, RetryOnResult(pending))
+	if err != nil || v != "pending" || c2 != 3 {
+		t.Errorf("result should be pending after 3 calls but get %v and %v after %v calls", v, err, c2)
+	}
+
+	// error on the last attempt
+	c3 := 0
+	if _, err := Do(New().MaxAttemptTimes(2), func() (string, error) {
+		c3++
+		if c3 < 2 {
+			return "pending", nil
+		}
+		return "", fmt.Errorf("")
+	}, RetryOnResult(pending)); err == nil {
+		t.Error("error should not be nil")
+	}
+
+	// canceled after a matched result
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if v, err := DoContext(ctx, New().MaxAttemptTimes(5).WaitFixed(time.Second), func() (string, error) {
+		cancel()
+		return "pending", nil
+	}, RetryOnResult(pending)); !errors.Is(err, context.Canceled) || v != "" {
+		t.Errorf("result should be empty and canceled but get %v and %v", v, err)
+	}
+
+	// other ends of retrying after a matched result
+	if v, err := Do(New().MaxAttemptTimes(5).BetweenAttempts(func(int, error) error { return io.EOF }), func() (string, error) {
+		return "pending", nil
+	}, RetryOnResult(pending)); !errors.Is(err, io.EOF) || v != "" {
+		t.Errorf("result should be empty and %v but get %v and %v", io.EOF, v, err)
+	}
+	if v, err := Do(New().MaxAttemptTimes(5).Budget(NewBudget(1, 0)), func() (string, error) {
+		return "pending", nil
+	}, RetryOnResult(pending)); err == nil || v != "" {
+		t.Errorf("result should be empty and error but get %v and %v", v, err)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	r := New().Concurrency(0)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidConcurrency) {
+		t.Errorf("error should be %v but get %v", ErrInvalidConcurrency, r.errors[0])
+	}
+}
+
+func TestDoAll(t *testing.T) {
+	// mixed success and failure
+	var calls int64
+	items := []int{1, 2, 3, 4}
+	results, errs := DoAll(items, func(i int) (int, error) {
+		atomic.AddInt64(&calls, 1)
+		if i%2 == 0 {
+			return 0, fmt.Errorf("even")
+		}
+		return i * 10, nil
+	}, Policy(New().MaxAttemptTimes(2)))
+	for i, item := range items {
+		if item%2 == 0 && (errs[i] == nil || results[i] != 0) {
+			t.Errorf("item %v should fail but get %v with %v", item, results[i], errs[i])
+		}
+		if item%2 == 1 && (errs[i] != nil || results[i] != item*10) {
+			t.Errorf("item %v should succeed but get %v with %v", item, results[i], errs[i])
+		}
+	}
+	if calls != 6 {
+		t.Errorf("function should be called 6 times but get %v", calls)
+	}
+
+	// concurrency limit
+	var running, maxRunning int64
+	_, errs = DoAll(make([]int, 10), func(int) (int, error) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+		atomic.AddInt64(&running, -1)
+		return 0, nil
+	}, WithConcurrency(3))
+	if maxRunning > 3 {
+		t.Errorf("max concurrency should be 3 but get %v", maxRunning)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("error of item %v should be nil but get %v", i, err)
+		}
+	}
+
+	// invalid options
+	_, errs = DoAll([]int{1}, func(int) (int, error) { return 0, nil }, WithConcurrency(-1))
+	if !errors.Is(errs[0], ErrInvalidConcurrency) {
+		t.Errorf("error should be %v but get %v", ErrInvalidConcurrency, errs[0])
+	}
+}
+
+func TestDoAllConcurrency(t *testing.T) {
+	// attempts in flight never exceed the limit
+	var running, maxRunning int64
+	calls := make([]int64, 4)
+	_, errs := DoAll([]int{0, 1, 2, 3}, func(i int) (int, error) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		defer atomic.AddInt64(&running, -1)
+
+		time.Sleep(time.Millisecond * 10)
+		if atomic.AddInt64(&calls[i], 1) == 1 {
+			return 0, fmt.Errorf("")
+		}
+		return 0, nil
+	}, Policy(New().MaxAttemptTimes(2).WaitFixed(time.Millisecond*100)), WithConcurrency(2))
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("error of item %v should be nil but get %v", i, err)
+		}
+	}
+	if maxRunning != 2 {
+		t.Errorf("max concurrency should be 2 but get %v", maxRunning)
+	}
+
+	// goroutines are bounded by the limit rather than the batch size
+	before := runtime.NumGoroutine()
+	var maxGoroutines int64
+	DoAll(make([]int, 1000), func(int) (int, error) {
+		n := int64(runtime.NumGoroutine())
+		for {
+			m := atomic.LoadInt64(&maxGoroutines)
+			if n <= m || atomic.CompareAndSwapInt64(&maxGoroutines, m, n) {
+				break
+			}
+		}
+		return 0, nil
+	}, WithConcurrency(4))
+	if maxGoroutines > int64(before+4) {
+		t.Errorf("goroutines should be at most %v but get %v", before+4, maxGoroutines)
+	}
+}
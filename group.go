@@ -0,0 +1,49 @@
+package retrying
+
+import (
+	"context"
+	"sync"
+)
+
+// Group run independent retryables concurrently and wait for all of them, e.g. steps of a startup sequence
+// the zero value is an empty group ready to use
+type Group struct {
+	names   []string
+	members map[string]*Retryable
+}
+
+// Add add r to the group under name, a member added earlier with the same name is replaced
+func (g *Group) Add(name string, r *Retryable) *Group {
+	if g.members == nil {
+		g.members = map[string]*Retryable{}
+	}
+	if _, ok := g.members[name]; !ok {
+		g.names = append(g.names, name)
+	}
+	g.members[name] = r
+	return g
+}
+
+// Run try all members concurrently until each is done or ctx is done
+// it returns final errors of members by name, succeeded members map to nil
+func (g *Group) Run(ctx context.Context) map[string]error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(map[string]error, len(g.names))
+	)
+	for _, name := range g.names {
+		wg.Add(1)
+		go func(name string, r *Retryable) {
+			defer wg.Done()
+			err := r.TryContext(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			errs[name] = err
+		}(name, g.members[name])
+	}
+	wg.Wait()
+
+	return errs
+}
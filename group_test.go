@@ -0,0 +1,53 @@
+package retrying
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	errCache := fmt.Errorf("cache is down")
+	c := 0
+	var g Group
+	g.Add("db", New().MaxAttemptTimes(3).Function(func() error {
+		c++
+		if c < 2 {
+			return fmt.Errorf("")
+		}
+		return nil
+	})).
+		Add("cache", New().MaxAttemptTimes(2).Function(func() error { return errCache })).
+		Add("discovery", New().Function(func() error { return fmt.Errorf("") })).
+		Add("discovery", New().Function(func() error { return nil }))
+
+	errs := g.Run(context.Background())
+	if len(errs) != 3 {
+		t.Fatalf("number of results should be 3 but get %v", len(errs))
+	}
+	if err := errs["db"]; err != nil {
+		t.Errorf("error of db should be nil but get %v", err)
+	}
+	if err := errs["cache"]; !errors.Is(err, errCache) {
+		t.Errorf("error of cache should be %v but get %v", errCache, err)
+	}
+	if err, ok := errs["discovery"]; !ok || err != nil {
+		t.Errorf("error of the replaced discovery should be nil but get %v", err)
+	}
+
+	// members stop when ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	errs = new(Group).Add("slow", New().MaxAttemptTimes(100).WaitFixed(time.Second).Function(func() error {
+		return fmt.Errorf("")
+	})).Run(ctx)
+	if err := errs["slow"]; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error of slow should be %v but get %v", context.DeadlineExceeded, err)
+	}
+
+	if errs := new(Group).Run(context.Background()); len(errs) != 0 {
+		t.Errorf("results of an empty group should be empty but get %v", errs)
+	}
+}
@@ -0,0 +1,67 @@
+package retrying
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// keys hold backoff state shared by tries with the same Key
+var keys sync.Map
+
+// Key share backoff of tries with the same key across the process, e.g. requests to the same endpoint
+// attempts of one key are serialized, and while a try of the key waits to retry others wait for it too
+// instead of starting their own attempts, keys should come from a bounded set as their state is kept
+func (r *Retryable) Key(key string) *Retryable {
+	r.key = key
+	return r
+}
+
+// keyState is the backoff state shared by tries of a key
+type keyState struct {
+	// slot is held by the attempt of the key in flight
+	slot chan struct{}
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+// sharedKey return the state of key
+func sharedKey(key string) *keyState {
+	k, _ := keys.LoadOrStore(key, &keyState{slot: make(chan struct{}, 1)})
+	return k.(*keyState)
+}
+
+// acquire take the slot of the key once the shared backoff is over
+func (k *keyState) acquire(ctx context.Context, clock Clock) error {
+	select {
+	case k.slot <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	k.mu.Lock()
+	d := k.until.Sub(clock.Now())
+	k.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-clock.After(d):
+		return nil
+	case <-ctx.Done():
+		k.release()
+		return ctx.Err()
+	}
+}
+
+func (k *keyState) release() {
+	<-k.slot
+}
+
+// backoff hold new attempts of the key until t, zero t ends the backoff
+func (k *keyState) backoff(t time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.until = t
+}
@@ -0,0 +1,101 @@
+package retrying
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	var (
+		inFlight, maxInFlight int32
+		mu                    sync.Mutex
+		failedAt              time.Time
+		starts                []time.Time
+		calls                 int32
+	)
+	f := func() error {
+		if n := atomic.AddInt32(&inFlight, 1); n > atomic.LoadInt32(&maxInFlight) {
+			atomic.StoreInt32(&maxInFlight, n)
+		}
+		defer atomic.AddInt32(&inFlight, -1)
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		// the first attempt fails and puts the key in backoff
+		if atomic.AddInt32(&calls, 1) == 1 {
+			failedAt = time.Now()
+			return errors.New("fail")
+		}
+		starts = append(starts, time.Now())
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := New().Key("TestKey").MaxAttemptTimes(2).WaitFixed(time.Millisecond * 50).Func(f).Try(); err != nil {
+				t.Errorf("error should be nil but get %v", err)
+			}
+		}()
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	// another key is not held by the backoff
+	start := time.Now()
+	if err := New().Key("TestKey/other").Func(func() error { return nil }).Try(); err != nil || time.Since(start) > time.Millisecond*20 {
+		t.Errorf("other key should not wait but get %v after %v", err, time.Since(start))
+	}
+	wg.Wait()
+
+	if maxInFlight != 1 {
+		t.Errorf("attempts of a key should be serialized but get %v in flight", maxInFlight)
+	}
+	if calls != 6 {
+		t.Errorf("calls should be 6 but get %v", calls)
+	}
+	for _, s := range starts {
+		if s.Sub(failedAt) < time.Millisecond*50 {
+			t.Errorf("attempts should wait for the shared backoff but start %v after the failure", s.Sub(failedAt))
+		}
+	}
+}
+
+func TestKeyInterrupted(t *testing.T) {
+	for _, drain := range []bool{false, true} {
+		var inFlight, maxInFlight int32
+		f := func() error {
+			if n := atomic.AddInt32(&inFlight, 1); n > atomic.LoadInt32(&maxInFlight) {
+				atomic.StoreInt32(&maxInFlight, n)
+			}
+			defer atomic.AddInt32(&inFlight, -1)
+			time.Sleep(time.Millisecond * 50)
+			return nil
+		}
+
+		// the attempt interrupted by MaxDelay keeps the key until it returns
+		key := fmt.Sprintf("TestKeyInterrupted/%v", drain)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := New().Key(key).MaxDelay(time.Millisecond * 10).DrainOnTimeout(drain).Func(f).Try(); !errors.Is(err, ErrTimeout) {
+				t.Errorf("error should be %v but get %v", ErrTimeout, err)
+			}
+		}()
+		time.Sleep(time.Millisecond * 5)
+		if err := New().Key(key).Func(f).Try(); err != nil {
+			t.Errorf("error should be nil but get %v", err)
+		}
+		<-done
+
+		if maxInFlight != 1 {
+			t.Errorf("attempts of a key should be serialized but get %v in flight with drain %v", maxInFlight, drain)
+		}
+	}
+}
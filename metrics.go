@@ -0,0 +1,51 @@
+package retrying
+
+import (
+	"sync"
+	"time"
+)
+
+// MetricsCollector receive metrics of all retries in the process, labeled by the configured Name
+// its methods are called from concurrent tries and should be safe for concurrent use
+type MetricsCollector interface {
+	// IncAttempt is called before each attempt
+	IncAttempt(name string)
+	// IncSuccess is called once a try succeeds
+	IncSuccess(name string)
+	// IncGiveUp is called once a try fails
+	IncGiveUp(name string)
+	// ObserveWait is called with the wait before each retry
+	ObserveWait(name string, d time.Duration)
+}
+
+var (
+	metricsMu sync.RWMutex
+	metricsC  MetricsCollector = noopCollector{}
+)
+
+// SetMetricsCollector register c as the collector of metrics of all retries in the process
+// nil restores the default collector which drops metrics
+func SetMetricsCollector(c MetricsCollector) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if c == nil {
+		c = noopCollector{}
+	}
+	metricsC = c
+}
+
+// metrics return the registered collector
+func metrics() MetricsCollector {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	return metricsC
+}
+
+// noopCollector drop all metrics
+type noopCollector struct{}
+
+func (noopCollector) IncAttempt(string)                 {}
+func (noopCollector) IncSuccess(string)                 {}
+func (noopCollector) IncGiveUp(string)                  {}
+func (noopCollector) ObserveWait(string, time.Duration) {}
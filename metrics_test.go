@@ -0,0 +1,68 @@
+package retrying
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeCollector struct {
+	mu     sync.Mutex
+	counts map[string]int
+	waits  []time.Duration
+}
+
+func (c *fakeCollector) inc(metric, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[metric+":"+name]++
+}
+
+func (c *fakeCollector) IncAttempt(name string) { c.inc("attempt", name) }
+func (c *fakeCollector) IncSuccess(name string) { c.inc("success", name) }
+func (c *fakeCollector) IncGiveUp(name string)  { c.inc("give_up", name) }
+
+func (c *fakeCollector) ObserveWait(name string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+}
+
+func TestMetricsCollector(t *testing.T) {
+	c := &fakeCollector{counts: map[string]int{}}
+	SetMetricsCollector(c)
+	defer SetMetricsCollector(nil)
+
+	// succeed after two retries
+	calls := 0
+	if err := New().Name("fetch").MaxAttemptTimes(5).WaitFixed(time.Millisecond).Func(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("fail")
+		}
+		return nil
+	}).Try(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+	// give up
+	New().Name("store").MaxAttemptTimes(2).Func(func() error { return errors.New("fail") }).Try()
+	// never run
+	New().Name("invalid").MaxAttemptTimes(0).Func(func() error { return nil }).Try()
+
+	expected := map[string]int{"attempt:fetch": 3, "success:fetch": 1, "attempt:store": 2, "give_up:store": 1}
+	if !reflect.DeepEqual(c.counts, expected) {
+		t.Errorf("counts should be %v but get %v", expected, c.counts)
+	}
+	if want := []time.Duration{time.Millisecond, time.Millisecond, 0}; !reflect.DeepEqual(c.waits, want) {
+		t.Errorf("waits should be %v but get %v", want, c.waits)
+	}
+
+	// the default collector drops metrics
+	SetMetricsCollector(nil)
+	New().Name("fetch").Func(func() error { return nil }).Try()
+	if c.counts["attempt:fetch"] != 3 {
+		t.Errorf("attempts should still be 3 but get %v", c.counts["attempt:fetch"])
+	}
+}
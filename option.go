@@ -0,0 +1,76 @@
+package retrying
+
+import "time"
+
+// Option configure a Retryable used by package level helpers like DoAll
+type Option func(*Retryable)
+
+// Policy use a copy of r as the configuration, options after it configure the copy
+func Policy(r *Retryable) Option {
+	return func(dst *Retryable) {
+		*dst = *r.Clone()
+	}
+}
+
+// MaxAttempts set max attempt times of package level helpers
+func MaxAttempts(n int64) Option {
+	return func(r *Retryable) {
+		r.MaxAttemptTimes(n)
+	}
+}
+
+// FixedWait set fixed wait between attempts of package level helpers
+func FixedWait(d time.Duration) Option {
+	return func(r *Retryable) {
+		r.WaitFixed(d)
+	}
+}
+
+// WithConcurrency limit number of items retried at once by batch helpers
+func WithConcurrency(n int) Option {
+	return func(r *Retryable) {
+		r.Concurrency(n)
+	}
+}
+
+// WithClock set the source of time used by package level helpers
+func WithClock(c Clock) Option {
+	return func(r *Retryable) {
+		r.Clock(c)
+	}
+}
+
+// WithBudget take retries of package level helpers from b
+func WithBudget(b *Budget) Option {
+	return func(r *Retryable) {
+		r.Budget(b)
+	}
+}
+
+// WithBreaker consult b before each attempt of package level helpers
+func WithBreaker(b Breaker) Option {
+	return func(r *Retryable) {
+		r.Breaker(b)
+	}
+}
+
+// TryFunc call fn with the policy configured by opts, e.g. TryFunc(fn, MaxAttempts(3), FixedWait(time.Second))
+func TryFunc(fn RetryableFunc, opts ...Option) error {
+	return newWithOptions(opts...).Func(fn).Try()
+}
+
+// WithKey share backoff of package level helpers with other tries of key
+func WithKey(key string) Option {
+	return func(r *Retryable) {
+		r.Key(key)
+	}
+}
+
+// newWithOptions create new retry configured by opts
+func newWithOptions(opts ...Option) *Retryable {
+	r := New()
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
@@ -0,0 +1,46 @@
+package retrying
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTryFunc(t *testing.T) {
+	// succeed after failed attempts
+	c := 0
+	start := time.Now()
+	err := TryFunc(func() error {
+		c++
+		if c < 3 {
+			return fmt.Errorf("error %v", c)
+		}
+		return nil
+	}, MaxAttempts(3), FixedWait(10*time.Millisecond))
+	if err != nil || c != 3 {
+		t.Errorf("error should be nil after 3 attempts but get %v after %v", err, c)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("attempts should wait 20ms but get %v", elapsed)
+	}
+
+	// exhaust attempts
+	c = 0
+	errFail := errors.New("fail")
+	if err := TryFunc(func() error {
+		c++
+		return errFail
+	}, MaxAttempts(2)); !errors.Is(err, errFail) || c != 2 {
+		t.Errorf("error should be %v after 2 attempts but get %v after %v", errFail, err, c)
+	}
+
+	// invalid options are not run
+	c = 0
+	if err := TryFunc(func() error {
+		c++
+		return nil
+	}, MaxAttempts(0), FixedWait(-1)); !errors.Is(err, ErrInvalidMaxAttempts) || !errors.Is(err, ErrInvalidWaitFixed) || c != 0 {
+		t.Errorf("error should be init errors without attempts but get %v after %v", err, c)
+	}
+}
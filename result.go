@@ -0,0 +1,36 @@
+package retrying
+
+import (
+	"context"
+	"time"
+)
+
+// Result is a summary of a completed try, e.g. for structured logging
+// field names in JSON are stable, Elapsed is marshaled in nanoseconds
+type Result struct {
+	Attempts  int           `json:"attempts"`
+	Elapsed   time.Duration `json:"elapsed"`
+	Succeeded bool          `json:"succeeded"`
+	TimedOut  bool          `json:"timed_out"`
+	// Errors are messages of failed attempts in order
+	Errors []string `json:"errors"`
+}
+
+// TryResultSummary is like Try but also return a summary of the try
+func (r *Retryable) TryResultSummary() (*Result, error) {
+	st := r.newState()
+	start := r.clock.Now()
+	attempts, err := r.run(context.Background(), st, r.wrapRecoverFunc(r.f))
+
+	res := &Result{
+		Attempts:  attempts,
+		Elapsed:   r.clock.Now().Sub(start),
+		Succeeded: err == nil,
+		TimedOut:  err != nil && st.timedOut,
+		Errors:    make([]string, 0, len(st.failed)),
+	}
+	for _, e := range st.failed {
+		res.Errors = append(res.Errors, e.Error())
+	}
+	return res, err
+}
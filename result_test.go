@@ -0,0 +1,52 @@
+package retrying
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTryResultSummary(t *testing.T) {
+	// success after failures
+	c1 := 0
+	res, err := New().MaxAttemptTimes(5).Function(func() error {
+		c1++
+		if c1 < 3 {
+			return fmt.Errorf("fail %v", c1)
+		}
+		return nil
+	}).TryResultSummary()
+	if err != nil || !res.Succeeded || res.TimedOut || res.Attempts != 3 {
+		t.Errorf("summary should be a success after 3 attempts but get %+v with %v", res, err)
+	}
+	if len(res.Errors) != 2 || res.Errors[0] != "fail 1" || res.Errors[1] != "fail 2" {
+		t.Errorf("errors should be [fail 1 fail 2] but get %v", res.Errors)
+	}
+
+	// exhaustion
+	res, err = New().MaxAttemptTimes(2).Function(func() error { return fmt.Errorf("") }).TryResultSummary()
+	if err == nil || res.Succeeded || res.TimedOut || res.Attempts != 2 || len(res.Errors) != 2 {
+		t.Errorf("summary should be a failure after 2 attempts but get %+v with %v", res, err)
+	}
+
+	// timeout
+	res, err = New().MaxAttemptTimes(2).MaxDelay(time.Millisecond * 20).Function(func() error {
+		time.Sleep(time.Millisecond * 50)
+		return nil
+	}).TryResultSummary()
+	if err == nil || res.Succeeded || !res.TimedOut || res.Attempts != 1 || len(res.Errors) != 0 {
+		t.Errorf("summary should be a timeout after 1 attempt but get %+v with %v", res, err)
+	}
+	if res.Elapsed < time.Millisecond*20 {
+		t.Errorf("elapsed should be at least 20ms but get %v", res.Elapsed)
+	}
+
+	b, err := json.Marshal(&Result{Attempts: 2, Elapsed: time.Second, TimedOut: true, Errors: []string{"a"}})
+	if err != nil {
+		t.Fatalf("error should be nil but get %v", err)
+	}
+	if expected := `{"attempts":2,"elapsed":1000000000,"succeeded":false,"timed_out":true,"errors":["a"]}`; string(b) != expected {
+		t.Errorf("json should be %v but get %s", expected, b)
+	}
+}
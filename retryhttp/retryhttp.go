@@ -0,0 +1,248 @@
+// Package retryhttp adapts retrying to net/http
+package retryhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yumimobi/retrying"
+)
+
+// DefaultStatusCodes are the response status codes retried by RoundTripper
+var DefaultStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// StatusError is returned by an attempt whose response has a retryable status code
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// RetryableStatus return a predicate reporting whether a response has one of codes, DefaultStatusCodes if empty
+// it composes with retrying.RetryOnResult for functions returning an *http.Response,
+// bodies of retried responses should be closed by the caller
+func RetryableStatus(codes ...int) func(*http.Response) bool {
+	if len(codes) == 0 {
+		codes = DefaultStatusCodes
+	}
+	codes = append([]int(nil), codes...)
+	return func(resp *http.Response) bool {
+		return resp != nil && hasStatus(codes, resp.StatusCode)
+	}
+}
+
+// Transport retries idempotent requests sent by Base with policy Retryable
+type Transport struct {
+	// Base sends each attempt, http.DefaultTransport is used if nil
+	Base http.RoundTripper
+	// Retryable is the retry policy of each request
+	Retryable *retrying.Retryable
+	// StatusCodes are the response status codes to retry
+	StatusCodes []int
+}
+
+// RoundTripper return a RoundTripper retrying idempotent requests sent by base with policy r
+// connection errors and responses with DefaultStatusCodes are retried,
+// a Retry-After header of a retried response sets the wait before the next attempt
+func RoundTripper(base http.RoundTripper, r *retrying.Retryable) http.RoundTripper {
+	return &Transport{
+		Base:        base,
+		Retryable:   r,
+		StatusCodes: DefaultStatusCodes,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+// requests which are not idempotent or whose body can not be rewound are sent once,
+// errors other than connection errors are not retried, and the last response is returned
+// once retries of a retryable status code run out, failed requests return the error of the last round trip
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Retryable == nil || !rewindable(req) {
+		return base.RoundTrip(req)
+	}
+
+	var (
+		mu      sync.Mutex
+		last    *http.Response
+		lastErr error
+		done    bool
+		first   = true
+	)
+	r := t.Retryable.Clone().AbortOn(errNotRetried)
+	_, err := retrying.DoContext(req.Context(), r, func() (struct{}, error) {
+		mu.Lock()
+		discard(last)
+		last, lastErr = nil, nil
+		attempt := req
+		rewind := !first
+		first = false
+		mu.Unlock()
+
+		var err error
+		if rewind {
+			attempt, err = rewound(req)
+		}
+		var resp *http.Response
+		if err == nil {
+			if resp, err = base.RoundTrip(attempt); err != nil && !connectionError(err) {
+				err = &notRetriedError{err: err}
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if !done {
+				lastErr = err
+			}
+			return struct{}{}, err
+		}
+		if done {
+			// the request has been given up while this attempt was in flight
+			discard(resp)
+			return struct{}{}, nil
+		}
+		last = resp
+		if !t.retryableStatus(resp.StatusCode) {
+			return struct{}{}, nil
+		}
+		err = &StatusError{StatusCode: resp.StatusCode}
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			err = retrying.RetryAfter(d, err)
+		}
+		return struct{}{}, err
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	done = true
+	var nr *notRetriedError
+	if errors.As(lastErr, &nr) {
+		lastErr = nr.err
+	}
+	// a round trip error accepted by SuccessOn or Classify still leaves no response to return
+	if err == nil && last == nil {
+		return nil, lastErr
+	}
+	// last is only kept by an attempt failed with a retryable status code
+	if err != nil && (last == nil || req.Context().Err() != nil) {
+		discard(last)
+		// http.Client reports the error of the last round trip rather than the aggregate of the retry
+		if lastErr != nil && req.Context().Err() == nil {
+			return nil, lastErr
+		}
+		return nil, err
+	}
+	return last, nil
+}
+
+// errNotRetried is matched by errors of round trips which are not retried
+var errNotRetried = errors.New("retryhttp: not retried")
+
+// notRetriedError mark an error of a round trip which is not retried
+type notRetriedError struct {
+	err error
+}
+
+func (e *notRetriedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notRetriedError) Is(target error) bool {
+	return target == errNotRetried
+}
+
+func (e *notRetriedError) Unwrap() error {
+	return e.err
+}
+
+// connectionError report whether err of a round trip is a network failure worth retrying
+func connectionError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (t *Transport) retryableStatus(code int) bool {
+	return hasStatus(t.StatusCodes, code)
+}
+
+func hasStatus(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// rewindable report whether req is idempotent and its body can be sent again
+func rewindable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewound return a copy of req with a fresh body
+func rewound(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return r, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = body
+	return r, nil
+}
+
+// discard drain and close the body of resp so that its connection can be reused
+func discard(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+}
+
+// retryAfter parse a Retry-After header in seconds or http date
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0, false
+		}
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,233 @@
+package retryhttp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yumimobi/retrying"
+)
+
+func TestRoundTripper(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != "payload" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer s.Close()
+
+	client := &http.Client{Transport: RoundTripper(nil, retrying.New().MaxAttemptTimes(5))}
+
+	// fail twice then succeed, the body is rewound on every attempt
+	req, _ := http.NewRequest(http.MethodPut, s.URL, strings.NewReader("payload"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("error should be nil but get %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("response should be 200 ok but get %v %s", resp.StatusCode, body)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("server should be called 3 times but get %v", n)
+	}
+
+	// requests which are not idempotent are sent once
+	atomic.StoreInt32(&calls, 0)
+	resp, err = client.Post(s.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("error should be nil but get %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status should be 503 but get %v", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("server should be called once but get %v", n)
+	}
+}
+
+func TestRoundTripperGiveUp(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+
+	// status codes which are not configured are not retried
+	client := &http.Client{Transport: RoundTripper(nil, retrying.New().MaxAttemptTimes(3))}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatalf("error should be nil but get %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("status should be 404 after 1 call but get %v after %v calls", resp.StatusCode, calls)
+	}
+
+	// configured status codes fail on all attempts and the last response is returned
+	atomic.StoreInt32(&calls, 0)
+	client.Transport = &Transport{
+		Retryable:   retrying.New().MaxAttemptTimes(3),
+		StatusCodes: []int{http.StatusNotFound},
+	}
+	resp, err = client.Get(s.URL)
+	if err != nil {
+		t.Fatalf("error should be nil but get %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status should be 404 but get %v", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("server should be called 3 times but get %v", n)
+	}
+}
+
+type errTransport struct {
+	calls int32
+	err   error
+}
+
+func (t *errTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.calls, 1)
+	return nil, t.err
+}
+
+func TestRoundTripperErrors(t *testing.T) {
+	errScheme := errors.New("unsupported protocol scheme")
+	cases := []struct {
+		err   error
+		calls int32
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, 3},
+		{io.EOF, 3},
+		{errScheme, 1},
+	}
+	for _, c := range cases {
+		base := &errTransport{err: c.err}
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		_, err := RoundTripper(base, retrying.New().MaxAttemptTimes(3)).RoundTrip(req)
+		if err != c.err || base.calls != c.calls {
+			t.Errorf("error should be %v after %v calls but get %v after %v calls", c.err, c.calls, err, base.calls)
+		}
+	}
+
+	// round trip errors accepted by the policy are still returned
+	for _, r := range []*retrying.Retryable{
+		retrying.New().SuccessOn(io.ErrUnexpectedEOF),
+		retrying.New().Classify(func(error) retrying.Action { return retrying.ActionSucceed }),
+	} {
+		base := &errTransport{err: io.ErrUnexpectedEOF}
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		resp, err := RoundTripper(base, r).RoundTrip(req)
+		if resp != nil || err != io.ErrUnexpectedEOF || base.calls != 1 {
+			t.Errorf("error should be %v after 1 call but get %v after %v calls", io.ErrUnexpectedEOF, err, base.calls)
+		}
+	}
+
+	// clients still detect timeouts of retried requests
+	client := &http.Client{Transport: RoundTripper(&errTransport{err: &net.DNSError{IsTimeout: true}}, retrying.New().MaxAttemptTimes(2))}
+	_, err := client.Get("http://example.com")
+	var ue *url.Error
+	if !errors.As(err, &ue) || !ue.Timeout() {
+		t.Errorf("error should be a timeout but get %v", err)
+	}
+}
+
+func TestRoundTripperRetryAfter(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 2 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}))
+	defer s.Close()
+
+	client := &http.Client{Transport: RoundTripper(nil, retrying.New().MaxAttemptTimes(2))}
+	start := time.Now()
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatalf("error should be nil but get %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retry should wait Retry-After but get %v", elapsed)
+	}
+}
+
+func TestRetryableStatus(t *testing.T) {
+	retryable := RetryableStatus()
+	for _, code := range []int{429, 500, 502, 503, 504} {
+		if !retryable(&http.Response{StatusCode: code}) {
+			t.Errorf("status %v should be retryable", code)
+		}
+	}
+	for _, code := range []int{http.StatusOK, http.StatusNotFound, http.StatusNotImplemented} {
+		if retryable(&http.Response{StatusCode: code}) {
+			t.Errorf("status %v should not be retryable", code)
+		}
+	}
+	if retryable(nil) {
+		t.Error("nil response should not be retryable")
+	}
+
+	retryable = RetryableStatus(http.StatusNotImplemented)
+	if !retryable(&http.Response{StatusCode: http.StatusNotImplemented}) || retryable(&http.Response{StatusCode: http.StatusServiceUnavailable}) {
+		t.Error("only configured status codes should be retryable")
+	}
+}
+
+func TestRetryableStatusOnResult(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer s.Close()
+
+	resp, err := retrying.Do(retrying.New().MaxAttemptTimes(5), func() (*http.Response, error) {
+		return http.Get(s.URL)
+	}, retrying.RetryOnResult(RetryableStatus()))
+	if err != nil {
+		t.Fatalf("error should be nil but get %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("status should be 200 after 3 calls but get %v after %v calls", resp.StatusCode, calls)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d, ok := retryAfter("3"); !ok || d != 3*time.Second {
+		t.Errorf("wait should be 3s but get %v %v", d, ok)
+	}
+	if d, ok := retryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)); !ok || d != 0 {
+		t.Errorf("wait should be 0 but get %v %v", d, ok)
+	}
+	for _, v := range []string{"", "-1", "soon"} {
+		if _, ok := retryAfter(v); ok {
+			t.Errorf("%q should not be parsed", v)
+		}
+	}
+}
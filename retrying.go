@@ -1,46 +1,299 @@
 package retrying
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/hashicorp/go-multierror"
 )
 
 // errors
 var (
+	// ErrTimeout is combined with errors of attempts failed before MaxDelay, match it with errors.Is
 	ErrTimeout             = fmt.Errorf("timeout error")
 	ErrNoFunctionSpecified = fmt.Errorf("no function is specified")
+
+	// ErrNotConfigured wraps errors occurred in initialization, the function is never called, match it with errors.Is
+	ErrNotConfigured = fmt.Errorf("retry is not configured")
+
+	// ErrReturnedFalse is returned by attempts of a function whose last output is a false bool
+	ErrReturnedFalse = fmt.Errorf("function returned false")
+
+	// ErrNotFound is returned by attempts of DoFound whose value is not found
+	ErrNotFound = fmt.Errorf("value is not found")
+
+	// ErrConditionNotMet is returned by attempts which succeeded before the condition of Until holds
+	ErrConditionNotMet = fmt.Errorf("condition is not met")
+
+	// ErrStopped is combined with errors of attempts failed before the stop chan fires, match it with errors.Is
+	ErrStopped = fmt.Errorf("retry is stopped")
+
+	// ErrProgress is matched by errors wrapped with Progress
+	ErrProgress = fmt.Errorf("progress made")
+
+	// ErrRetryImmediately can be returned or wrapped by the function to retry without waiting
+	ErrRetryImmediately = fmt.Errorf("retry immediately")
+
+	// ErrCircuitOpen is combined with errors of attempts made before the breaker refuses one, match it with errors.Is
+	ErrCircuitOpen = fmt.Errorf("circuit breaker is open")
+)
+
+// TimeoutError is combined with errors of attempts failed before MaxDelay, it matches ErrTimeout with errors.Is
+type TimeoutError struct {
+	// Elapsed is the duration of the try until it timed out
+	Elapsed time.Duration
+	// Attempts is the number of attempts completed before the timeout
+	Attempts int
+}
+
+func (e *TimeoutError) Error() string {
+	return ErrTimeout.Error()
+}
+
+// Is report whether target is ErrTimeout
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// Progress wrap err of a failed attempt which made progress, e.g. a connection which stayed healthy for a while,
+// so that the backoff restarts from its base wait instead of keeping growing
+func Progress(err error) error {
+	return &progressError{err: err}
+}
+
+type progressError struct {
+	err error
+}
+
+func (e *progressError) Error() string {
+	if e.err == nil {
+		return ErrProgress.Error()
+	}
+	return e.err.Error()
+}
+
+func (e *progressError) Is(target error) bool {
+	return target == ErrProgress
+}
+
+func (e *progressError) Unwrap() error {
+	return e.err
+}
+
+// RetryAfterError can be returned or wrapped by the function to wait Duration
+// instead of the configured wait before the next attempt, negative Duration is ignored
+type RetryAfterError struct {
+	Duration time.Duration
+	Err      error
+}
+
+// RetryAfter wrap err so that the next attempt happens after d, e.g. from a Retry-After header
+func RetryAfter(d time.Duration, err error) error {
+	return &RetryAfterError{Duration: d, Err: err}
+}
+
+func (e *RetryAfterError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("retry after %v", e.Duration)
+	}
+	return fmt.Sprintf("retry after %v: %v", e.Duration, e.Err)
+}
+
+// Unwrap return the underlying error
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// errors wrapped by initialization errors, match them with errors.Is
+var (
+	ErrInvalidStackSize                    = fmt.Errorf("invalid stack size")
+	ErrInvalidMaxAttempts                  = fmt.Errorf("invalid max attempt times")
+	ErrInvalidMaxRetries                   = fmt.Errorf("invalid max retries")
+	ErrInvalidStartAttempt                 = fmt.Errorf("invalid start attempt")
+	ErrInvalidStopAfterRepeatedError       = fmt.Errorf("invalid stop after repeated error")
+	ErrInvalidMaxDelay                     = fmt.Errorf("invalid max delay")
+	ErrInvalidTimeoutWaitPolicy            = fmt.Errorf("invalid timeout wait policy")
+	ErrInvalidMaxElapsedTime               = fmt.Errorf("invalid max elapsed time")
+	ErrInvalidMaxTotalWait                 = fmt.Errorf("invalid max total wait")
+	ErrInvalidWaitFixed                    = fmt.Errorf("invalid wait fixed")
+	ErrInvalidWaitRandom                   = fmt.Errorf("invalid wait random")
+	ErrInvalidMaxInterval                  = fmt.Errorf("invalid max interval")
+	ErrInvalidWaitExponential              = fmt.Errorf("invalid wait exponential")
+	ErrInvalidRandSource                   = fmt.Errorf("invalid rand source")
+	ErrInvalidClock                        = fmt.Errorf("invalid clock")
+	ErrInvalidBudget                       = fmt.Errorf("invalid budget")
+	ErrInvalidBreaker                      = fmt.Errorf("invalid breaker")
+	ErrInvalidWaitRandomExponential        = fmt.Errorf("invalid wait random exponential")
+	ErrInvalidWaitExponentialWithJitterCap = fmt.Errorf("invalid wait exponential with jitter cap")
+	ErrInvalidWaitConstantThenBackoff      = fmt.Errorf("invalid wait constant then backoff")
+	ErrInvalidWaitPolynomial               = fmt.Errorf("invalid wait polynomial")
+	ErrInvalidWaitLinear                   = fmt.Errorf("invalid wait linear")
+	ErrInvalidWaitWeighted                 = fmt.Errorf("invalid wait weighted")
+	ErrInvalidWaitFunc                     = fmt.Errorf("invalid wait func")
+	ErrInvalidWaitModifier                 = fmt.Errorf("invalid wait modifier")
+	ErrInvalidWaitFixedJitter              = fmt.Errorf("invalid wait fixed jitter")
+	ErrInvalidStopChan                     = fmt.Errorf("invalid stop chan")
+	ErrInvalidGate                         = fmt.Errorf("invalid gate")
+	ErrInvalidMaxErrorMessageLen           = fmt.Errorf("invalid max error message length")
+	ErrInvalidRetryOn                      = fmt.Errorf("invalid retry on")
+	ErrInvalidAbortOn                      = fmt.Errorf("invalid abort on")
+	ErrInvalidSuccessOn                    = fmt.Errorf("invalid success on")
+	ErrInvalidEvents                       = fmt.Errorf("invalid events")
+	ErrInvalidConcurrency                  = fmt.Errorf("invalid concurrency")
+	ErrInvalidCallback                     = fmt.Errorf("invalid callback")
+	ErrInvalidFunction                     = fmt.Errorf("invalid function")
 )
 
 const (
-	defaultStackSize       = 4096
+	defaultStackSize       = 1024
+	maxStackSize           = 64 << 20
 	defaultMaxAttemptTimes = 1
 )
 
-var errorInterface = reflect.TypeOf((*error)(nil)).Elem()
+var (
+	errorInterface   = reflect.TypeOf((*error)(nil)).Elem()
+	contextInterface = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
 
 // can be mocked out for test
 var sleep = time.Sleep
 
+// Attempt model consisting of a finished attempt passed to OnRetry and Events
+type Attempt struct {
+	// Label is set by Label to correlate attempts with the originating operation
+	Label string
+	// Number of the attempt which starts from 1
+	Number int
+	// Start time of the attempt
+	Start time.Time
+	// Err returned by the attempt
+	Err error
+	// NextWait is the duration to wait before the next attempt, zero if no attempt follows
+	NextWait time.Duration
+}
+
+// state model consisting of run state of a single try
+type state struct {
+	attempts int64
+	// errors is allocated by the first failed attempt, so immediate success does not touch multierror
+	errors *multierror.Error
+	// failed holds errors of failed attempts only, without ErrTimeout and ErrStopped
+	failed []error
+
+	// until is the deadline of new attempts set by TryUntil
+	until time.Time
+	start time.Time
+
+	// lastErr is repeated by repeats consecutive attempts
+	lastErr error
+	repeats int
+
+	// backoffStart is subtracted from attempt numbers passed to wait strategies,
+	// it starts negative with StartAttempt
+	backoffStart int
+	totalWait    time.Duration
+
+	clock   Clock
+	timer   *time.Timer
+	metrics MetricsCollector
+	// key is held during attempts of a try with Key
+	key     *keyState
+	keyHeld bool
+	// workers are goroutines spawned by the try, they are joined before it returns
+	workers sync.WaitGroup
+
+	timedOut bool
+	// final is set once a wait is fitted by TimeoutWaitPolicy, the attempt after it is the last one
+	final bool
+	// events is the chan of TryEvents
+	events chan Attempt
+	// exhausted is set when the last attempt failed with no attempt left under MaxAttemptTimes
+	exhausted bool
+}
+
 // Retryable model consisting of retry options
+// once configured it is safe to call Try concurrently
 type Retryable struct {
 	stackSize     int
+	stackFixed    bool
+	autoGrowStack bool
 	allGoroutines bool
 
 	maxAttemptTimes int64
 	maxDelay        time.Duration
+	timeoutWait     TimeoutWaitPolicy
+	drainOnTimeout  bool
+	maxElapsedTime  time.Duration
+	maxTotalWait    time.Duration
+	maxRepeats      int
 
 	waitFixed                    time.Duration
 	waitRandomMin, waitRandomMax time.Duration
+	waitStrategy                 func(r *Retryable, attempt int, err error) time.Duration
+	waitModifier                 func(attempt int, computed time.Duration) time.Duration
+	maxInterval                  time.Duration
+	startAttempt                 int
+	noJitterFirst                bool
+
+	rand  *rand.Rand
+	clock Clock
+
+	f            func(ctx context.Context) error
+	attemptCtx   bool
+	results      func(ctx context.Context) ([]interface{}, error)
+	panicHandler func(recovered interface{}, stack []byte) error
+	noRecover    bool
+	// retryRuntimePanics retries panics of runtime errors which stop retrying by default
+	retryRuntimePanics bool
+
+	stopChan <-chan struct{}
+	gate     <-chan struct{}
+
+	retryOn, abortOn []error
+	successOn        []error
+	cond             func() bool
+	classify         func(err error) Action
+
+	concurrency int
+	budget      *Budget
+	breaker     Breaker
+	key         string
+
+	annotateErrors         bool
+	joinErrors             bool
+	collectErrorsOnSuccess bool
+	maxErrorMessageLen     int
+	name                   string
+
+	label           string
+	onRetry         func(a Attempt)
+	betweenAttempts func(attempt int, err error) error
+	events          chan<- Attempt
 
-	f func() error
+	onStart   func()
+	onSuccess func(attempts int)
+	onGiveUp  func(attempts int, err error)
 
-	errors []error
+	// last is set by the last run, clones get their own
+	last *lastRun
+
+	errors  []error
+	lenient bool
+}
+
+// lastRun is the outcome of the last run reported by TimedOut and Errors
+type lastRun struct {
+	timedOut int32
+	errors   atomic.Value
 }
 
 // New create new retry
@@ -48,181 +301,1341 @@ func New() *Retryable {
 	return &Retryable{
 		stackSize:       defaultStackSize,
 		maxAttemptTimes: defaultMaxAttemptTimes,
-		f:               func() error { return ErrNoFunctionSpecified },
+		clock:           realClock{},
+		last:            &lastRun{},
 	}
 }
 
 // Stack set stack parameters used in runtime.Stack
+// stacks captured on panic are truncated to n bytes, by default the buffer grows until the whole stack fits
 func (r *Retryable) Stack(n int, all bool) *Retryable {
 	if n <= 0 {
-		r.errors = append(r.errors, fmt.Errorf("stack size must be positive integer"))
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive integer", ErrInvalidStackSize))
+		return r
 	}
 	r.stackSize = n
+	r.stackFixed = true
 	r.allGoroutines = all
 	return r
 }
 
-// MaxAttemptTimes set max attempt times
+// AutoGrowStack set whether the stack buffer keeps doubling until the whole stack fits even if Stack fixed its size
+// the buffer never grows beyond 64MB, false restores the default where Stack fixes the size
+func (r *Retryable) AutoGrowStack(grow bool) *Retryable {
+	r.autoGrowStack = grow
+	return r
+}
+
+// MaxAttemptTimes set max attempt times, i.e. total calls of the function
+// MaxAttemptTimes(n) is the same as MaxRetries(n-1)
 func (r *Retryable) MaxAttemptTimes(n int64) *Retryable {
 	if n <= 0 {
-		r.errors = append(r.errors, fmt.Errorf("max attempt times must be positive integer"))
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive integer", ErrInvalidMaxAttempts))
+		return r
 	}
 	r.maxAttemptTimes = n
 	return r
 }
 
+// MaxRetries set max retry times after the initial attempt, i.e. n+1 total calls of the function
+// MaxRetries(n) is the same as MaxAttemptTimes(n+1)
+func (r *Retryable) MaxRetries(n int) *Retryable {
+	if n < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: must not be negative integer", ErrInvalidMaxRetries))
+		return r
+	}
+	r.maxAttemptTimes = math.MaxInt64
+	if int64(n) < math.MaxInt64 {
+		r.maxAttemptTimes = int64(n) + 1
+	}
+	return r
+}
+
+// StopAfterRepeatedError stop retrying once n consecutive attempts return the same error matched by errors.Is
+// it bails out of hopeless loops before MaxAttemptTimes is reached
+func (r *Retryable) StopAfterRepeatedError(n int) *Retryable {
+	if n <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive integer", ErrInvalidStopAfterRepeatedError))
+		return r
+	}
+	r.maxRepeats = n
+	return r
+}
+
 // MaxDelay set max delay duration
+// a running attempt is interrupted once it is reached, Try returns at once while by default the attempt
+// keeps running in the background until it returns, unless DrainOnTimeout is set
 func (r *Retryable) MaxDelay(d time.Duration) *Retryable {
 	if d <= 0 {
-		r.errors = append(r.errors, fmt.Errorf("max delay must be positive duration"))
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive duration", ErrInvalidMaxDelay))
+		return r
 	}
 	r.maxDelay = d
 	return r
 }
 
+// TimeoutWaitPolicy decide what happens to a wait which would outlast MaxDelay
+type TimeoutWaitPolicy int
+
+// timeout wait policies
+const (
+	// PolicyWaitTimeout keep waiting until MaxDelay interrupts the wait, it is the default
+	PolicyWaitTimeout TimeoutWaitPolicy = iota
+	// PolicySkipWait skip the wait and make a final attempt immediately, retrying stops after it
+	PolicySkipWait
+	// PolicyClampWait shorten the wait so that a final attempt as long as the last one ends before MaxDelay,
+	// unlike sleeping until the deadline this leaves the final attempt time to run, retrying stops after it
+	PolicyClampWait
+)
+
+// TimeoutWaitPolicy set policy of waits which would outlast MaxDelay
+func (r *Retryable) TimeoutWaitPolicy(p TimeoutWaitPolicy) *Retryable {
+	if p < PolicyWaitTimeout || p > PolicyClampWait {
+		r.errors = append(r.errors, fmt.Errorf("%w: unknown policy %d", ErrInvalidTimeoutWaitPolicy, p))
+		return r
+	}
+	r.timeoutWait = p
+	return r
+}
+
+// DrainOnTimeout set whether Try waits for an attempt interrupted by MaxDelay or ctx to return before returning
+// so that no background work of the try remains, the attempt should return once the ctx of FunctionContext is done
+// it is off by default, so MaxDelay bounds Try and the interrupted attempt outlives it
+func (r *Retryable) DrainOnTimeout(drain bool) *Retryable {
+	r.drainOnTimeout = drain
+	return r
+}
+
+// MaxElapsedTime set max elapsed time after which no more attempt is made
+// unlike MaxDelay a running attempt is never interrupted, retrying stops at whichever of
+// MaxAttemptTimes and MaxElapsedTime is reached first
+func (r *Retryable) MaxElapsedTime(d time.Duration) *Retryable {
+	if d <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive duration", ErrInvalidMaxElapsedTime))
+		return r
+	}
+	r.maxElapsedTime = d
+	return r
+}
+
+// MaxTotalWait set max cumulative duration of waits between attempts
+// retrying stops instead of a wait which would exceed it, a running attempt is never interrupted
+func (r *Retryable) MaxTotalWait(d time.Duration) *Retryable {
+	if d <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive duration", ErrInvalidMaxTotalWait))
+		return r
+	}
+	r.maxTotalWait = d
+	return r
+}
+
 // WaitFixed set fixed wait duration
 func (r *Retryable) WaitFixed(d time.Duration) *Retryable {
 	if d <= 0 {
-		r.errors = append(r.errors, fmt.Errorf("wait fixed must be positive duration"))
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive duration", ErrInvalidWaitFixed))
+		return r
 	}
 	r.waitFixed = d
 	return r
 }
 
-// WaitRandom set min/max random
+// NoWait retry immediately after failed attempts, it clears WaitFixed, WaitRandom and other wait strategies
+// waits requested by the function via RetryAfter still apply
+func (r *Retryable) NoWait() *Retryable {
+	r.waitFixed = 0
+	r.waitRandomMin, r.waitRandomMax = 0, 0
+	r.waitStrategy = nil
+	return r
+}
+
+// WaitRandom set min/max random, min equal to max is a fixed wait
 func (r *Retryable) WaitRandom(min, max time.Duration) *Retryable {
+	errs := len(r.errors)
 	if min < 0 || max < 0 {
-		r.errors = append(r.errors, fmt.Errorf("wait random min/max must be positive duration"))
+		r.errors = append(r.errors, fmt.Errorf("%w: min/max must be positive duration", ErrInvalidWaitRandom))
 	}
-	if min >= max {
-		r.errors = append(r.errors, fmt.Errorf("wait random min must be smaller than max"))
+	if min > max {
+		r.errors = append(r.errors, fmt.Errorf("%w: min must not be greater than max", ErrInvalidWaitRandom))
+	}
+	if len(r.errors) > errs {
+		return r
 	}
 	r.waitRandomMin, r.waitRandomMax = min, max
 	return r
 }
 
+// StopChan set chan which stops retrying once it is closed or receives
+// the running wait is interrupted and no more attempt is made
+func (r *Retryable) StopChan(ch <-chan struct{}) *Retryable {
+	if ch == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: must not be nil", ErrInvalidStopChan))
+		return r
+	}
+	r.stopChan = ch
+	return r
+}
+
+// Gate set chan which holds each retry after its wait until it receives or is closed
+// e.g. to step through attempts in tests, ctx and MaxDelay still interrupt the hold
+func (r *Retryable) Gate(ch <-chan struct{}) *Retryable {
+	if ch == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: must not be nil", ErrInvalidGate))
+		return r
+	}
+	r.gate = ch
+	return r
+}
+
+// RetryOn set errors to retry on, matched by errors.Is, other errors stop retrying
+func (r *Retryable) RetryOn(errs ...error) *Retryable {
+	if len(errs) == 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: errors must not be empty", ErrInvalidRetryOn))
+		return r
+	}
+	r.retryOn = append(r.retryOn, errs...)
+	return r
+}
+
+// AbortOn set errors to stop retrying on, matched by errors.Is
+// it takes precedence over RetryOn
+func (r *Retryable) AbortOn(errs ...error) *Retryable {
+	if len(errs) == 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: errors must not be empty", ErrInvalidAbortOn))
+		return r
+	}
+	r.abortOn = append(r.abortOn, errs...)
+	return r
+}
+
+// Until set condition checked after each successful call, e.g. to poll until a resource is ready
+// calls are retried with ErrConditionNotMet until cond returns true, which RetryOn, AbortOn, SuccessOn, Classify
+// and StopAfterRepeatedError never apply to
+func (r *Retryable) Until(cond func() bool) *Retryable {
+	if cond == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: until condition must not be nil", ErrInvalidCallback))
+		return r
+	}
+	r.cond = cond
+	return r
+}
+
+// SuccessOn set errors meaning the function is done, matched by errors.Is, e.g. io.EOF
+// retrying stops and Try returns nil once the function returns one of them
+func (r *Retryable) SuccessOn(errs ...error) *Retryable {
+	if len(errs) == 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: errors must not be empty", ErrInvalidSuccessOn))
+		return r
+	}
+	r.successOn = append(r.successOn, errs...)
+	return r
+}
+
+// Action is the outcome of an error classified by Classify
+type Action int
+
+// actions
+const (
+	// ActionRetry retry the error, RetryOn and AbortOn still apply
+	ActionRetry Action = iota
+	// ActionFail stop retrying and fail
+	ActionFail
+	// ActionSucceed stop retrying and treat the error as an acceptable result, Try returns nil
+	ActionSucceed
+)
+
+// Classify set function deciding the action of each error returned by the function
+func (r *Retryable) Classify(f func(err error) Action) *Retryable {
+	if f == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: classify callback must not be nil", ErrInvalidCallback))
+		return r
+	}
+	r.classify = f
+	return r
+}
+
+// RecoverPanics set whether panics of the function are recovered as failed attempts, true by default
+// disabling it removes the recover wrapper from hot loops, panics then propagate to the caller of Try
+// or crash the program if MaxDelay runs the attempt in its own goroutine
+func (r *Retryable) RecoverPanics(enabled bool) *Retryable {
+	r.noRecover = !enabled
+	return r
+}
+
+// RetryRuntimePanics set whether panics of runtime errors like nil dereference or index out of range are retried
+// they are bugs which retrying would mask, so by default they stop retrying like errors of AbortOn,
+// other panics like panic("retry me") are retried
+func (r *Retryable) RetryRuntimePanics(retry bool) *Retryable {
+	r.retryRuntimePanics = retry
+	return r
+}
+
+// PanicHandler set function converting a recovered panic and its stack into an error
+// it replaces the default formatting of panic value and stack, the recovered value can be type switched
+// e.g. to tell runtime.Error from user panics, errors of runtime panics still stop retrying by default
+func (r *Retryable) PanicHandler(h func(recovered interface{}, stack []byte) error) *Retryable {
+	if h == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: panic handler must not be nil", ErrInvalidCallback))
+		return r
+	}
+	r.panicHandler = h
+	return r
+}
+
+// Name set name prefixing errors returned by Try, e.g. "retry[fetch-user]: timeout error"
+// it is purely cosmetic and errors.Is still matches the wrapped errors
+func (r *Retryable) Name(name string) *Retryable {
+	r.name = name
+	return r
+}
+
+// AnnotateErrors set whether errors of failed attempts are prefixed with attempt number and elapsed time
+// e.g. "attempt 2 after 1.3s: ...", annotated errors still unwrap to the original ones
+func (r *Retryable) AnnotateErrors(annotate bool) *Retryable {
+	r.annotateErrors = annotate
+	return r
+}
+
+// JoinErrors set whether errors of failed attempts are combined with errors.Join instead of go-multierror
+// the error message lists each error on its own line instead of the multierror bullet list
+func (r *Retryable) JoinErrors(join bool) *Retryable {
+	r.joinErrors = join
+	return r
+}
+
+// CollectErrorsOnSuccess set whether Errors keeps errors of attempts failed before a success, e.g. for auditing
+// they are dropped by default to save memory
+func (r *Retryable) CollectErrorsOnSuccess(collect bool) *Retryable {
+	r.collectErrorsOnSuccess = collect
+	return r
+}
+
+// MaxErrorMessageLen set max number of bytes of the message of a returned error, longer ones are cut on a rune
+// boundary and end with "..." which counts toward n
+// the error still unwraps to errors of all failed attempts, which are also returned by Errors
+func (r *Retryable) MaxErrorMessageLen(n int) *Retryable {
+	if n <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive integer", ErrInvalidMaxErrorMessageLen))
+		return r
+	}
+	r.maxErrorMessageLen = n
+	return r
+}
+
+// Label set label passed to hooks in Attempt
+func (r *Retryable) Label(label string) *Retryable {
+	r.label = label
+	return r
+}
+
+// OnRetry set callback invoked after each failed attempt which is followed by another one, before the wait
+// NextWait of the attempt is exactly the duration waited next, e.g. for logging "retrying in X"
+func (r *Retryable) OnRetry(f func(a Attempt)) *Retryable {
+	if f == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: on retry callback must not be nil", ErrInvalidCallback))
+		return r
+	}
+	r.onRetry = f
+	return r
+}
+
+// BetweenAttempts set cleanup invoked after each failed attempt which is followed by another one, before the wait
+// e.g. to roll back side effects, an error of the cleanup is combined with the others and stops retrying
+func (r *Retryable) BetweenAttempts(f func(attempt int, err error) error) *Retryable {
+	if f == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: between attempts callback must not be nil", ErrInvalidCallback))
+		return r
+	}
+	r.betweenAttempts = f
+	return r
+}
+
+// Events set chan receiving an Attempt after each finished attempt of every try, it is owned and never closed
+// by the Retryable, use TryEvents for a chan closed when the try returns
+// attempts are dropped rather than blocking retrying if ch is not ready, so buffer ch for slow consumers
+func (r *Retryable) Events(ch chan<- Attempt) *Retryable {
+	if ch == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: must not be nil", ErrInvalidEvents))
+		return r
+	}
+	r.events = ch
+	return r
+}
+
+// OnStart set callback invoked once before the first attempt, e.g. to open a span wrapping the whole retry
+func (r *Retryable) OnStart(f func()) *Retryable {
+	if f == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: on start callback must not be nil", ErrInvalidCallback))
+		return r
+	}
+	r.onStart = f
+	return r
+}
+
+// OnSuccess set callback invoked once with the number of attempts when the function succeeds
+func (r *Retryable) OnSuccess(f func(attempts int)) *Retryable {
+	if f == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: on success callback must not be nil", ErrInvalidCallback))
+		return r
+	}
+	r.onSuccess = f
+	return r
+}
+
+// OnGiveUp set callback invoked once with the number of attempts and the final error when retrying gives up
+func (r *Retryable) OnGiveUp(f func(attempts int, err error)) *Retryable {
+	if f == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: on give up callback must not be nil", ErrInvalidCallback))
+		return r
+	}
+	r.onGiveUp = f
+	return r
+}
+
+// RetryableFunc is the most common signature of retried functions
+type RetryableFunc = func() error
+
+// Func set function like Function but without reflection, it is the fast path of the common signature
+func (r *Retryable) Func(fn RetryableFunc) *Retryable {
+	if fn == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: function must not be nil", ErrInvalidFunction))
+		return r
+	}
+	r.f = func(context.Context) error { return fn() }
+	r.attemptCtx = false
+	r.results = func(context.Context) ([]interface{}, error) {
+		return []interface{}{}, fn()
+	}
+	return r
+}
+
+// FunctionContext set function receiving the context of each attempt
+// it is done when ctx of TryContext is done or MaxDelay is reached, so that the function can stop early
+func (r *Retryable) FunctionContext(fn func(ctx context.Context) error) *Retryable {
+	if fn == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: function must not be nil", ErrInvalidFunction))
+		return r
+	}
+	r.f = fn
+	r.attemptCtx = true
+	r.results = func(ctx context.Context) ([]interface{}, error) {
+		return []interface{}{}, fn(ctx)
+	}
+	return r
+}
+
+// FunctionAttempt set function receiving the number of the attempt which starts from 1
+// and the number of attempts remaining after it, e.g. to use a fallback on the last chance
+func (r *Retryable) FunctionAttempt(fn func(attempt, remaining int) error) *Retryable {
+	if fn == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: function must not be nil", ErrInvalidFunction))
+		return r
+	}
+	return r.FunctionContext(func(ctx context.Context) error {
+		attempt, remaining, _ := AttemptFromContext(ctx)
+		return fn(attempt, remaining)
+	})
+}
+
+type attemptKey struct{}
+
+type attemptInfo struct {
+	number, remaining int
+}
+
+// AttemptFromContext return the number of the attempt and remaining attempts after it
+// from the context passed to functions set by FunctionContext, ok is false for other contexts
+func AttemptFromContext(ctx context.Context) (attempt, remaining int, ok bool) {
+	info, ok := ctx.Value(attemptKey{}).(attemptInfo)
+	return info.number, info.remaining, ok
+}
+
 // Function set function
-// i should be a function with no output or last output should be an error
+// i should be a function with no output or last output should be an error or a bool,
+// a false bool is treated as a failed attempt with ErrReturnedFalse
 func (r *Retryable) Function(i interface{}) *Retryable {
 	typ := reflect.TypeOf(i)
+	if typ == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: function must not be nil", ErrInvalidFunction))
+		return r
+	}
 	if kind := typ.Kind(); kind != reflect.Func {
-		r.errors = append(r.errors, fmt.Errorf("expected type %v but get %v", reflect.Func, kind))
+		r.errors = append(r.errors, fmt.Errorf("%w: expected type %v but get %v", ErrInvalidFunction, reflect.Func, kind))
 		return r
 	}
-	if n := typ.NumIn(); n != 0 {
-		r.errors = append(r.errors, fmt.Errorf("expected 0 inputs but get %v", n))
+	if reflect.ValueOf(i).IsNil() {
+		r.errors = append(r.errors, fmt.Errorf("%w: function of type %v must not be nil", ErrInvalidFunction, typ))
+		return r
+	}
+	errs := len(r.errors)
+	if name, ok := unboundMethod(reflect.ValueOf(i)); ok {
+		r.errors = append(r.errors, fmt.Errorf("%w: expected 0 inputs but get unbound method expression %v.%v, "+
+			"pass a method value bound to its receiver like x.%v instead", ErrInvalidFunction, typ.In(0), name, name))
+	} else if contextFunc(typ) {
+		r.errors = append(r.errors, fmt.Errorf("%w: expected 0 inputs but get %v, "+
+			"use FunctionContext for functions receiving the context of attempts", ErrInvalidFunction, typ))
+	} else if n := typ.NumIn(); n != 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: expected 0 inputs but get %v", ErrInvalidFunction, n))
 	}
-	if n := typ.NumOut(); n > 0 && !typ.Out(n-1).Implements(errorInterface) {
-		r.errors = append(r.errors, fmt.Errorf("expected 0 output or last output implements error interface"))
+	n := typ.NumOut()
+	returnsBool := n > 0 && !typ.Out(n-1).Implements(errorInterface) && typ.Out(n-1).Kind() == reflect.Bool
+	if n > 0 && !typ.Out(n-1).Implements(errorInterface) && !returnsBool {
+		r.errors = append(r.errors, fmt.Errorf("%w: expected 0 output or last output implements error interface or is bool", ErrInvalidFunction))
+	}
+	if len(r.errors) > errs {
+		return r
 	}
 
 	val := reflect.ValueOf(i)
-	switch typ.NumOut() {
-	case 0:
-		r.f = r.wrapRecoverFunc(func() error {
-			val.Call(nil)
-			return nil
-		})
-	default:
-		r.f = r.wrapRecoverFunc(func() error {
-			outputs := val.Call(nil)
-			lastOutput := outputs[len(outputs)-1]
-			if lastOutput.IsNil() {
-				return nil
+	results := func(context.Context) ([]interface{}, error) {
+		outputs := val.Call(nil)
+		if n == 0 {
+			return []interface{}{}, nil
+		}
+
+		results := make([]interface{}, 0, n-1)
+		for _, output := range outputs[:n-1] {
+			results = append(results, output.Interface())
+		}
+
+		lastOutput := outputs[n-1]
+		switch {
+		case returnsBool:
+			if !lastOutput.Bool() {
+				return results, ErrReturnedFalse
 			}
-			return lastOutput.Interface().(error)
-		})
+		case !nilable(lastOutput.Kind()) || !lastOutput.IsNil():
+			return results, lastOutput.Interface().(error)
+		}
+		return results, nil
+	}
+	r.results = results
+	r.attemptCtx = false
+	r.f = func(ctx context.Context) error {
+		_, err := results(ctx)
+		return err
 	}
 
 	return r
 }
 
+// Clone return a copy of r which can be configured independently
+// the copy shares the Events, StopChan and Gate chans, the Budget and the Breaker of r
+func (r *Retryable) Clone() *Retryable {
+	c := *r
+	c.errors = append([]error(nil), r.errors...)
+	c.retryOn = append([]error(nil), r.retryOn...)
+	c.abortOn = append([]error(nil), r.abortOn...)
+	c.successOn = append([]error(nil), r.successOn...)
+	c.last = &lastRun{}
+	return &c
+}
+
+// LenientConfig set whether Try proceeds despite errors occurred in initialization
+// invalid option values are never applied, so with lenient config they fall back to defaults
+// and the dropped errors are returned by Validate and Errors instead of Try
+func (r *Retryable) LenientConfig(lenient bool) *Retryable {
+	r.lenient = lenient
+	return r
+}
+
+// Validate return errors occurred in initialization without calling the function
+func (r *Retryable) Validate() error {
+	return multierror.Append(nil, r.errors...).ErrorOrNil()
+}
+
+// MustBuild return r and panic if errors occurred in initialization
+// like regexp.MustCompile it simplifies initialization of policies in global variables
+func (r *Retryable) MustBuild() *Retryable {
+	if err := r.Validate(); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// MustTry is like Try but panic if errors occurred in initialization
+// errors of failed attempts are still returned
+func (r *Retryable) MustTry() error {
+	return r.MustBuild().Try()
+}
+
 // Try call the wrap function with retry options
+// an attempt interrupted by MaxDelay keeps running after Try returns unless DrainOnTimeout is set
 func (r *Retryable) Try() error {
-	errors := multierror.Append(nil, r.errors...)
+	return r.TryContext(context.Background())
+}
+
+// Run is like Try but errors of a failed run are combined with errors.Join into a single error
+// it lets a Retryable be the function of another, e.g. outer.Func(inner.Run) retries bursts of inner attempts
+// and the outer errors keep one entry per inner run
+func (r *Retryable) Run() error {
+	return join(r.Try())
+}
+
+// TryContext call the wrap function with retry options until ctx is done
+// waits between attempts are interrupted by ctx and never outlast its deadline
+func (r *Retryable) TryContext(ctx context.Context) error {
+	return r.try(ctx, r.wrapRecoverFunc(r.f))
+}
 
-	// stop if errors occur in initialization
-	if err := errors.ErrorOrNil(); err != nil {
+// TryUntil is like Try but no attempt is started once deadline is reached
+// like MaxElapsedTime the first attempt is always made and running attempts are never interrupted
+func (r *Retryable) TryUntil(deadline time.Time) error {
+	st := r.newState()
+	st.until = deadline
+	_, err := r.run(context.Background(), st, r.wrapRecoverFunc(r.f))
+	return err
+}
+
+// TimedOut report whether the last Try was terminated by MaxDelay
+// it is false for failures which exhausted attempts or were canceled
+func (r *Retryable) TimedOut() bool {
+	return atomic.LoadInt32(&r.last.timedOut) == 1
+}
+
+// Errors return errors of failed attempts of the last Try in order, ErrTimeout and ErrStopped are not included
+// it is empty if the try succeeded unless CollectErrorsOnSuccess is set,
+// with LenientConfig errors occurred in initialization come first
+func (r *Retryable) Errors() []error {
+	var errs []error
+	if r.lenient {
+		errs = append(errs, r.errors...)
+	}
+	last, _ := r.last.errors.Load().([]error)
+	return append(errs, last...)
+}
+
+// TryCounted is like Try but also return number of attempts made
+func (r *Retryable) TryCounted() (int, error) {
+	return r.run(context.Background(), r.newState(), r.wrapRecoverFunc(r.f))
+}
+
+// TryResult is like Try but also return outputs of the last successful call except the trailing error or bool
+// outputs are in declaration order so that callers can type assert each of them,
+// it is empty for functions with no other output
+func (r *Retryable) TryResult() ([]interface{}, error) {
+	if r.results == nil {
+		return []interface{}{}, r.Try()
+	}
+
+	var (
+		mu      sync.Mutex
+		results []interface{}
+	)
+	err := r.try(context.Background(), r.wrapRecoverFunc(func(ctx context.Context) error {
+		res, err := r.results(ctx)
+		if err == nil {
+			mu.Lock()
+			results = res
+			mu.Unlock()
+		}
 		return err
+	}))
+	if err != nil {
+		return nil, err
 	}
 
-	// try with or without timeout
-	if r.maxDelay > 0 {
-		return r.tryWithTimeout()
+	mu.Lock()
+	defer mu.Unlock()
+	return results, nil
+}
+
+// TryValue is like TryResult but return only the first output of the last successful call
+// it fits functions like func() (T, error), nil is returned for functions with no other output
+func (r *Retryable) TryValue() (interface{}, error) {
+	results, err := r.TryResult()
+	if err != nil || len(results) == 0 {
+		return nil, err
 	}
-	return r.tryWithoutTimeout()
+	return results[0], nil
+}
+
+// TryAsync run Try in a goroutine and deliver its result on the returned chan
+// exactly one result is sent before the chan is closed
+func (r *Retryable) TryAsync() <-chan error {
+	return r.TryAsyncContext(context.Background())
+}
+
+// TryAsyncContext run TryContext in a goroutine and deliver its result on the returned chan
+// exactly one result is sent before the chan is closed
+func (r *Retryable) TryAsyncContext(ctx context.Context) <-chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(errChan)
+		errChan <- r.TryContext(ctx)
+	}()
+	return errChan
+}
+
+// TryEvents run TryContext in a goroutine and return a fresh chan receiving an Attempt after each finished attempt
+// the chan is closed once the try returns, before its result is delivered on the error chan,
+// attempts are dropped rather than blocking retrying once buffer attempts are pending
+func (r *Retryable) TryEvents(ctx context.Context, buffer int) (<-chan Attempt, <-chan error) {
+	st := r.newState()
+	events := make(chan Attempt, buffer)
+	st.events = events
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(errChan)
+		_, err := r.run(ctx, st, r.wrapRecoverFunc(r.f))
+		close(events)
+		errChan <- err
+	}()
+	return events, errChan
 }
 
 // helpers
-//
-func (r *Retryable) wrapRecoverFunc(f func() error) func() error {
-	return func() (err error) {
+func (r *Retryable) try(ctx context.Context, f func(ctx context.Context) error) error {
+	_, err := r.run(ctx, r.newState(), f)
+	return err
+}
+
+// newState create run state of a try
+func (r *Retryable) newState() *state {
+	return &state{clock: r.clock, backoffStart: -r.startAttempt}
+}
+
+// run call f with retry options and return number of attempts made
+func (r *Retryable) run(ctx context.Context, st *state, f func(ctx context.Context) error) (int, error) {
+	atomic.StoreInt32(&r.last.timedOut, 0)
+	r.last.errors.Store([]error(nil))
+
+	// stop if errors occur in initialization unless they are dropped by lenient config
+	if err := r.Validate(); err != nil && !r.lenient {
+		return 0, &configError{err: err}
+	}
+	if f == nil {
+		return 0, &configError{err: multierror.Append(nil, ErrNoFunctionSpecified)}
+	}
+
+	// each try owns its run state, the config is only read
+	st.metrics = metrics()
+	counted := func(ctx context.Context) error {
+		atomic.AddInt64(&st.attempts, 1)
+		st.metrics.IncAttempt(r.name)
+		return f(ctx)
+	}
+
+	// deferred before any cancel so that workers are joined after they are signaled
+	defer st.workers.Wait()
+
+	// stop chan cancels the try like ctx does
+	var stopped int32
+	if r.stopChan != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		st.workers.Add(1)
+		go func() {
+			defer st.workers.Done()
+			select {
+			case <-r.stopChan:
+				atomic.StoreInt32(&stopped, 1)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	if r.onStart != nil {
+		r.onStart()
+	}
+	err := r.tryLoop(ctx, st, counted)
+	st.stopTimer()
+	if err != nil && st.timedOut {
+		atomic.StoreInt32(&r.last.timedOut, 1)
+	}
+	if err != nil || r.collectErrorsOnSuccess {
+		r.last.errors.Store(st.failed)
+	}
+	if err != nil && atomic.LoadInt32(&stopped) == 1 {
+		err = multierror.Append(st.errors, ErrStopped)
+	}
+	if err != nil && r.joinErrors {
+		err = join(err)
+	}
+	if err != nil && r.name != "" {
+		err = &namedError{name: r.name, err: err}
+	}
+	if err != nil && r.maxErrorMessageLen > 0 {
+		err = &truncatedError{n: r.maxErrorMessageLen, err: err}
+	}
+
+	attempts := int(atomic.LoadInt64(&st.attempts))
+	if err == nil {
+		st.metrics.IncSuccess(r.name)
+	} else {
+		st.metrics.IncGiveUp(r.name)
+	}
+	if err == nil && r.onSuccess != nil {
+		r.onSuccess(attempts)
+	}
+	if err != nil && r.onGiveUp != nil {
+		r.onGiveUp(attempts, err)
+	}
+	return attempts, err
+}
+
+func (r *Retryable) wrapRecoverFunc(f func(ctx context.Context) error) func(ctx context.Context) error {
+	if r.noRecover || f == nil {
+		return f
+	}
+	return func(ctx context.Context) (err error) {
 		defer func() {
 			if e := recover(); e != nil {
-				buf := make([]byte, r.stackSize)
-				runtime.Stack(buf, r.allGoroutines)
-				err = fmt.Errorf("%v\n%s\n", e, buf)
+				err = r.panicError(e, captureStack(r.stackSize, r.allGoroutines, r.autoGrowStack || !r.stackFixed))
+				if _, ok := e.(runtime.Error); ok && err != nil && !r.retryRuntimePanics {
+					err = &runtimePanicError{err: err}
+				}
 			}
 		}()
 
-		return f()
+		return f(ctx)
 	}
 }
 
-func (r *Retryable) wait() {
-	duration := r.waitFixed
-	if duration <= 0 && r.waitRandomMax > r.waitRandomMin {
-		duration = r.waitRandomMin + time.Duration(rand.Int63n(int64(r.waitRandomMax-r.waitRandomMin)))
+// panicError convert a recovered panic and its stack into an error
+func (r *Retryable) panicError(e interface{}, buf []byte) error {
+	if r.panicHandler != nil {
+		return r.panicHandler(e, buf)
+	}
+	// panicked errors stay matchable with errors.Is and errors.As
+	if perr, ok := e.(error); ok {
+		return fmt.Errorf("%w\n%s\n", perr, buf)
 	}
-	sleep(duration)
+	return fmt.Errorf("%v\n%s\n", e, buf)
 }
 
-func (r *Retryable) tryWithTimeout() error {
-	errors := &multierror.Error{}
-	errChan := make(chan error, r.maxAttemptTimes)
-	timer := time.NewTimer(r.maxDelay)
-	count := r.maxAttemptTimes
+// join convert a multierror into an errors.Join error, nested multierrors are converted too
+func join(err error) error {
+	me, ok := err.(*multierror.Error)
+	if !ok {
+		return err
+	}
+	errs := make([]error, 0, len(me.Errors))
+	for _, e := range me.Errors {
+		errs = append(errs, join(e))
+	}
+	return errors.Join(errs...)
+}
 
-	go func() {
-		for atomic.LoadInt64(&count) > 0 {
-			atomic.AddInt64(&count, -1)
-			errChan <- r.f()
-			r.wait()
+// namedError prefix an error with the name of the retryable
+type namedError struct {
+	name string
+	err  error
+}
+
+func (e *namedError) Error() string {
+	return fmt.Sprintf("retry[%v]: %v", e.name, e.err)
+}
+
+func (e *namedError) Unwrap() error {
+	return e.err
+}
+
+// truncatedError cut the message of an error to n bytes
+type truncatedError struct {
+	n   int
+	err error
+}
+
+func (e *truncatedError) Error() string {
+	const ellipsis = "..."
+	msg := e.err.Error()
+	if len(msg) <= e.n {
+		return msg
+	}
+	if e.n <= len(ellipsis) {
+		return ellipsis[:e.n]
+	}
+	// cut on a rune boundary so that the message stays valid utf-8
+	end := e.n - len(ellipsis)
+	for end > 0 && !utf8.RuneStart(msg[end]) {
+		end--
+	}
+	return msg[:end] + ellipsis
+}
+
+func (e *truncatedError) Unwrap() error {
+	return e.err
+}
+
+// runtimePanicError mark an error recovered from a panic of a runtime error, which is not retried
+type runtimePanicError struct {
+	err error
+}
+
+func (e *runtimePanicError) Error() string {
+	return e.err.Error()
+}
+
+func (e *runtimePanicError) Unwrap() error {
+	return e.err
+}
+
+// configError mark errors occurred in initialization, its message is the one of the wrapped error
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+func (e *configError) Is(target error) bool {
+	return target == ErrNotConfigured
+}
+
+// attemptError annotate an error with its attempt number and elapsed time
+type attemptError struct {
+	attempt int
+	elapsed time.Duration
+	err     error
+}
+
+func (e *attemptError) Error() string {
+	return fmt.Sprintf("attempt %v after %v: %v", e.attempt, e.elapsed, e.err)
+}
+
+func (e *attemptError) Unwrap() error {
+	return e.err
+}
+
+func (r *Retryable) annotate(attempt int, elapsed time.Duration, err error) error {
+	if err == nil || !r.annotateErrors {
+		return err
+	}
+	return &attemptError{attempt: attempt, elapsed: elapsed.Round(time.Millisecond), err: err}
+}
+
+// emit send a to events of r and of the try without blocking
+func (r *Retryable) emit(st *state, a Attempt) {
+	if r.events != nil {
+		select {
+		case r.events <- a:
+		default:
 		}
-	}()
+	}
+	if st.events != nil {
+		select {
+		case st.events <- a:
+		default:
+		}
+	}
+}
 
+// retryable report whether err of a failed attempt is allowed to be retried by RetryOn and AbortOn
+func (r *Retryable) retryable(err error) bool {
+	var rp *runtimePanicError
+	// unmet conditions of Until are retried whatever the error filters are
+	if err == ErrConditionNotMet {
+		return true
+	}
+	if errors.As(err, &rp) || matchAny(err, r.abortOn) {
+		return false
+	}
+	return len(r.retryOn) == 0 || matchAny(err, r.retryOn)
+}
+
+func matchAny(err error, targets []error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// contextFunc report whether typ is func(context.Context) error or func(context.Context)
+func contextFunc(typ reflect.Type) bool {
+	if typ.NumIn() != 1 || typ.In(0) != contextInterface {
+		return false
+	}
+	return typ.NumOut() == 0 || (typ.NumOut() == 1 && typ.Out(0) == errorInterface)
+}
+
+// nilable report whether IsNil can be called on values of kind
+func nilable(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return true
+	}
+	return false
+}
+
+// unboundMethod report name of the method if val is a method expression like (*T).M whose only input is the receiver
+func unboundMethod(val reflect.Value) (string, bool) {
+	typ := val.Type()
+	if typ.NumIn() != 1 {
+		return "", false
+	}
+	recv := typ.In(0)
+	for i := 0; i < recv.NumMethod(); i++ {
+		if m := recv.Method(i); m.Func.IsValid() && m.Func.Pointer() == val.Pointer() {
+			return m.Name, true
+		}
+	}
+	return "", false
+}
+
+// captureStack return stack captured by runtime.Stack in a buffer of size bytes
+// the buffer is doubled until the stack fits if grow is set
+func captureStack(size int, all, grow bool) []byte {
 	for {
+		buf := make([]byte, size)
+		n := runtime.Stack(buf, all)
+		if !grow || n < size || size >= maxStackSize {
+			return buf[:n]
+		}
+		size *= 2
+	}
+}
+
+// waitDuration compute duration to wait after the given attempt which starts from 1 and failed with err
+func (r *Retryable) waitDuration(attempt int, err error) time.Duration {
+	// the function overrides the wait of this attempt
+	if errors.Is(err, ErrRetryImmediately) {
+		return 0
+	}
+	var retryAfter *RetryAfterError
+	if errors.As(err, &retryAfter) && retryAfter.Duration >= 0 {
+		return retryAfter.Duration
+	}
+
+	var duration time.Duration
+	if r.waitStrategy != nil {
+		// strategies take r rather than the retryable they were set on, so that clones apply their own wait options
+		duration = r.waitStrategy(r, attempt, err)
+	} else if duration = r.waitFixed; duration <= 0 {
+		duration = r.waitRandomMin
+		if r.waitRandomMax > r.waitRandomMin {
+			duration += time.Duration(r.int63n(int64(r.waitRandomMax - r.waitRandomMin)))
+		}
+	}
+
+	if r.waitModifier != nil {
+		if duration = r.waitModifier(attempt, duration); duration < 0 {
+			duration = 0
+		}
+	}
+	return r.capInterval(duration)
+}
+
+// fitWait apply TimeoutWaitPolicy to wait which leaves remaining time before MaxDelay,
+// last is the duration of the attempt just failed, final reports whether the wait was fitted
+func (r *Retryable) fitWait(wait, remaining, last time.Duration) (fitted time.Duration, final bool) {
+	if wait < remaining {
+		return wait, false
+	}
+	switch r.timeoutWait {
+	case PolicySkipWait:
+		return 0, true
+	case PolicyClampWait:
+		if d := remaining - last; d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return wait, false
+}
+
+// wait sleep duration unless ctx is done first
+// a single timer is reused across waits of the try
+func (st *state) wait(ctx context.Context, duration time.Duration) error {
+	// ctx can never be done, plain sleep is enough
+	if ctx.Done() == nil {
+		st.clock.Sleep(duration)
+		return nil
+	}
+
+	// timers of other clocks are not reused
+	if _, ok := st.clock.(realClock); !ok {
 		select {
-		case err := <-errChan:
-			errors = multierror.Append(errors, err)
+		case <-st.clock.After(duration):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
-			if err == nil {
-				atomic.StoreInt64(&count, 0)
-				return nil
-			}
+	// deadline comes first, sleep until it then give up
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < duration {
+		<-ctx.Done()
+		return ctx.Err()
+	}
 
-			if atomic.LoadInt64(&count) <= 0 {
-				return errors.ErrorOrNil()
-			}
-		case <-timer.C:
-			return ErrTimeout
+	if st.timer == nil {
+		st.timer = time.NewTimer(duration)
+	} else {
+		st.stopTimer()
+		st.timer.Reset(duration)
+	}
+
+	select {
+	case <-st.timer.C:
+		return nil
+	case <-ctx.Done():
+		st.stopTimer()
+		return ctx.Err()
+	}
+}
+
+// repeated count err and report whether it has been returned by max consecutive attempts
+func (st *state) repeated(err error, max int) bool {
+	if max <= 0 {
+		return false
+	}
+	if st.lastErr != nil && (errors.Is(err, st.lastErr) || errors.Is(err, rootError(st.lastErr))) {
+		st.repeats++
+	} else {
+		st.lastErr, st.repeats = err, 1
+	}
+	return st.repeats >= max
+}
+
+// rootError return the innermost error wrapped by err, so that freshly wrapped sentinels are compared by the sentinel
+func rootError(err error) error {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return err
+		}
+		err = next
+	}
+}
+
+// releaseKey release the key if it is held by the try
+func (st *state) releaseKey() {
+	if st.keyHeld {
+		st.keyHeld = false
+		st.key.release()
+	}
+}
+
+// stopTimer stop the timer and drain a pending fire so that it never leaks into the next wait
+func (st *state) stopTimer() {
+	if st.timer != nil && !st.timer.Stop() {
+		select {
+		case <-st.timer.C:
+		default:
 		}
 	}
 }
 
-func (r *Retryable) tryWithoutTimeout() error {
-	errors := &multierror.Error{}
+// tryLoop call f until it succeeds or any of MaxAttemptTimes, MaxElapsedTime, MaxDelay and ctx stops it
+func (r *Retryable) tryLoop(parent context.Context, st *state, f func(ctx context.Context) error) error {
+	ctx := parent
+	if r.maxDelay > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withDeadline(parent, r.clock, r.maxDelay, &st.workers)
+		defer cancel()
+	}
+
+	if r.key != "" {
+		st.key = sharedKey(r.key)
+		defer st.releaseKey()
+	}
 
-	for count := r.maxAttemptTimes; count > 0; count-- {
-		err := r.f()
-		errors = multierror.Append(errors, err)
+	start := r.clock.Now()
+	st.start = start
+	for attempt := 1; int64(attempt) <= r.maxAttemptTimes; attempt++ {
+		// max elapsed time and the deadline of TryUntil stop new attempts but never interrupt a running one
+		if attempt > 1 && r.maxElapsedTime > 0 && r.clock.Now().Sub(start) >= r.maxElapsedTime {
+			break
+		}
+		if attempt > 1 && !st.until.IsZero() && !r.clock.Now().Before(st.until) {
+			break
+		}
+
+		// no doomed attempt is started once MaxDelay or ctx expired during the wait
+		if ctx.Err() != nil {
+			return r.interruptedError(parent, st)
+		}
+		// attempts of a key wait for its backoff shared with other tries
+		if st.key != nil {
+			if st.key.acquire(ctx, r.clock) != nil {
+				return r.interruptedError(parent, st)
+			}
+			st.keyHeld = true
+		}
+		// every allowed attempt is recorded, so that a half open breaker never waits for a lost trial
+		if r.breaker != nil && !r.breaker.Allow() {
+			return multierror.Append(st.errors, ErrCircuitOpen)
+		}
+		a := Attempt{Label: r.label, Number: attempt, Start: r.clock.Now()}
+		actx := ctx
+		if r.attemptCtx {
+			// computed in int64 and clamped, so that int stays in range on 32-bit platforms
+			remaining := r.maxAttemptTimes - int64(attempt)
+			if remaining > math.MaxInt {
+				remaining = math.MaxInt
+			}
+			actx = context.WithValue(ctx, attemptKey{}, attemptInfo{number: attempt, remaining: int(remaining)})
+		}
+		finished, err := r.call(actx, st, f)
+		if !finished {
+			if r.breaker != nil {
+				r.breaker.Record(false)
+			}
+			return r.interruptedError(parent, st)
+		}
+		if err == nil && r.cond != nil && !r.cond() {
+			err = ErrConditionNotMet
+		}
+		action := ActionRetry
+		if err != nil && err != ErrConditionNotMet && matchAny(err, r.successOn) {
+			err = nil
+		}
+		if err != nil && err != ErrConditionNotMet && r.classify != nil {
+			// accepted errors end the try like a success
+			if action = r.classify(err); action == ActionSucceed {
+				err = nil
+			}
+		}
+		if r.breaker != nil {
+			r.breaker.Record(err == nil)
+		}
+		if err != nil {
+			failed := r.annotate(attempt, r.clock.Now().Sub(start), err)
+			st.errors = multierror.Append(st.errors, failed)
+			st.failed = append(st.failed, failed)
+		}
+		a.Err = err
 
 		if err == nil {
+			if st.key != nil {
+				st.key.backoff(time.Time{})
+			}
+			r.emit(st, a)
 			return nil
 		}
+		if int64(attempt) >= r.maxAttemptTimes {
+			st.exhausted = true
+			r.emit(st, a)
+			break
+		}
+		if st.final || action == ActionFail || !r.retryable(err) || (err != ErrConditionNotMet && st.repeated(err, r.maxRepeats)) {
+			r.emit(st, a)
+			break
+		}
 
-		r.wait()
+		// the wait is computed once so that hooks see exactly what is slept
+		// progress restarts the backoff sequence from its base
+		if errors.Is(err, ErrProgress) {
+			st.backoffStart = attempt - 1
+		}
+		wait := r.waitDuration(attempt-st.backoffStart, err)
+		if r.maxDelay > 0 {
+			wait, st.final = r.fitWait(wait, r.maxDelay-r.clock.Now().Sub(start), r.clock.Now().Sub(a.Start))
+		}
+
+		// no attempt follows a wait outlasting the deadline of TryUntil, so it stops before the wait
+		if !st.until.IsZero() && !r.clock.Now().Add(wait).Before(st.until) {
+			r.emit(st, a)
+			break
+		}
+
+		// max total wait stops before a wait that would exceed it
+		if r.maxTotalWait > 0 && st.totalWait+wait > r.maxTotalWait {
+			r.emit(st, a)
+			break
+		}
+		st.totalWait += wait
+
+		// an exhausted budget stops before the retry
+		if r.budget != nil && !r.budget.take() {
+			r.emit(st, a)
+			break
+		}
+
+		// a failed cleanup stops before the retry
+		if r.betweenAttempts != nil {
+			if cerr := r.betweenAttempts(attempt, err); cerr != nil {
+				st.errors = multierror.Append(st.errors, cerr)
+				r.emit(st, a)
+				break
+			}
+		}
+
+		a.NextWait = wait
+		if r.onRetry != nil {
+			r.onRetry(a)
+		}
+		r.emit(st, a)
+		st.metrics.ObserveWait(r.name, a.NextWait)
+		if st.key != nil {
+			st.key.backoff(r.clock.Now().Add(a.NextWait))
+			st.releaseKey()
+		}
+
+		// zero waits never sleep
+		if a.NextWait > 0 && st.wait(ctx, a.NextWait) != nil {
+			return r.interruptedError(parent, st)
+		}
+		if r.gate != nil {
+			select {
+			case <-r.gate:
+			case <-ctx.Done():
+				return r.interruptedError(parent, st)
+			}
+		}
+	}
+
+	return st.errors.ErrorOrNil()
+}
+
+// call f, it is interrupted by ctx only if MaxDelay is set
+func (r *Retryable) call(ctx context.Context, st *state, f func(ctx context.Context) error) (finished bool, err error) {
+	if r.maxDelay <= 0 {
+		return true, f(ctx)
+	}
+
+	errChan := make(chan error, 1)
+	if r.drainOnTimeout {
+		st.workers.Add(1)
 	}
+	go func() {
+		if r.drainOnTimeout {
+			defer st.workers.Done()
+		}
+		errChan <- f(ctx)
+	}()
 
-	return errors.ErrorOrNil()
+	select {
+	case err := <-errChan:
+		return true, err
+	case <-ctx.Done():
+		// the interrupted attempt keeps the key until it returns, so no other attempt of the key overlaps it
+		if st.keyHeld {
+			st.keyHeld = false
+			if r.drainOnTimeout {
+				st.workers.Add(1)
+			}
+			go func(k *keyState) {
+				if r.drainOnTimeout {
+					defer st.workers.Done()
+				}
+				<-errChan
+				k.release()
+			}(st.key)
+		}
+		return false, nil
+	}
+}
+
+// interruptedError return error of parent if it is done, otherwise MaxDelay is reached
+func (r *Retryable) interruptedError(parent context.Context, st *state) error {
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	// keep errors of attempts failed before the timeout
+	st.timedOut = true
+	return multierror.Append(st.errors, &TimeoutError{
+		Elapsed:  r.clock.Now().Sub(st.start),
+		Attempts: len(st.failed),
+	})
 }
@@ -1,11 +1,22 @@
 package retrying
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/yumimobi/retrying/retryingtest"
 )
 
 func TestStack(t *testing.T) {
@@ -13,56 +24,1778 @@ func TestStack(t *testing.T) {
 	if len(r.errors) != 1 {
 		t.Error("number of errors should be 1")
 	}
+	if !errors.Is(r.errors[0], ErrInvalidStackSize) {
+		t.Errorf("error should be %v but get %v", ErrInvalidStackSize, r.errors[0])
+	}
+}
+
+func TestDeepStack(t *testing.T) {
+	var deep func(n int)
+	deep = func(n int) {
+		if n == 0 {
+			panic("deep panic")
+		}
+		deep(n - 1)
+	}
+	capture := func(r *Retryable) (stack []byte) {
+		r.PanicHandler(func(_ interface{}, s []byte) error {
+			stack = s
+			return fmt.Errorf("")
+		}).Function(func() { deep(200) }).Try()
+		return stack
+	}
+
+	// grown until the whole stack fits
+	if stack := capture(New()); len(stack) <= defaultStackSize || !strings.Contains(string(stack), "TestDeepStack") {
+		t.Errorf("stack should not be truncated but get %v bytes", len(stack))
+	}
+
+	// truncated to the fixed size
+	if stack := capture(New().Stack(defaultStackSize, false)); len(stack) != defaultStackSize {
+		t.Errorf("stack should be truncated to %v bytes but get %v", defaultStackSize, len(stack))
+	}
+
+	// grown regardless of the fixed size, in any order
+	for _, r := range []*Retryable{
+		New().Stack(64, false).AutoGrowStack(true),
+		New().AutoGrowStack(true).Stack(64, false),
+	} {
+		if stack := capture(r); len(stack) <= 64 || !strings.Contains(string(stack), "TestDeepStack") {
+			t.Errorf("stack should not be truncated but get %v bytes", len(stack))
+		}
+	}
+}
+
+func TestMaxAttemptTimes(t *testing.T) {
+	r := New().MaxAttemptTimes(-1)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidMaxAttempts) {
+		t.Errorf("error should be %v but get %v", ErrInvalidMaxAttempts, r.errors[0])
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	r := New().MaxRetries(-1)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidMaxRetries) {
+		t.Errorf("error should be %v but get %v", ErrInvalidMaxRetries, r.errors[0])
+	}
+
+	for n, expected := range map[int]int{0: 1, 2: 3} {
+		calls := 0
+		if err := New().MaxRetries(n).Function(func() error {
+			calls++
+			return fmt.Errorf("")
+		}).Try(); err == nil {
+			t.Error("error should not be nil")
+		}
+		if calls != expected {
+			t.Errorf("function should be called %v times but get %v", expected, calls)
+		}
+	}
+
+	// retrying practically forever does not overflow
+	calls := 0
+	if err := New().MaxRetries(math.MaxInt).Function(func() error {
+		calls++
+		if calls == 3 {
+			return nil
+		}
+		return fmt.Errorf("")
+	}).Try(); err != nil || calls != 3 {
+		t.Errorf("error should be nil after 3 calls but get %v after %v calls", err, calls)
+	}
+}
+
+func TestMaxDelay(t *testing.T) {
+	r := New().MaxDelay(time.Duration(0))
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidMaxDelay) {
+		t.Errorf("error should be %v but get %v", ErrInvalidMaxDelay, r.errors[0])
+	}
+}
+
+func TestTryUntil(t *testing.T) {
+	c1 := 0
+	start := time.Now()
+	err := New().MaxAttemptTimes(100).
+		WaitFixed(time.Millisecond * 10).
+		Function(func() error {
+			c1++
+			return fmt.Errorf("")
+		}).
+		TryUntil(start.Add(time.Millisecond * 50))
+	elapsed := time.Since(start)
+	if err == nil || c1 < 2 || c1 > 6 {
+		t.Errorf("function should fail about 5 times but get %v calls with %v", c1, err)
+	}
+	if elapsed < time.Millisecond*30 || elapsed > time.Millisecond*70 {
+		t.Errorf("try should stop around 50ms but get %v", elapsed)
+	}
+
+	// a wait outlasting the deadline is not slept
+	start = time.Now()
+	err = New().MaxAttemptTimes(3).
+		WaitFixed(time.Second * 10).
+		Func(func() error { return fmt.Errorf("") }).
+		TryUntil(start.Add(time.Second))
+	if elapsed := time.Since(start); err == nil || elapsed > time.Millisecond*100 {
+		t.Errorf("try should stop before the wait but get %v after %v", err, elapsed)
+	}
+
+	// the first attempt is made after the deadline
+	c2 := 0
+	err = New().MaxAttemptTimes(3).Function(func() error {
+		c2++
+		return fmt.Errorf("")
+	}).TryUntil(time.Now().Add(-time.Second))
+	if err == nil || c2 != 1 {
+		t.Errorf("function should fail once but get %v calls with %v", c2, err)
+	}
+}
+
+func TestTimeoutWaitPolicy(t *testing.T) {
+	r := New().TimeoutWaitPolicy(TimeoutWaitPolicy(-1))
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidTimeoutWaitPolicy) {
+		t.Errorf("error should be %v but get %v", ErrInvalidTimeoutWaitPolicy, r.errors[0])
+	}
+
+	ms := time.Millisecond
+	cases := []struct {
+		policy   TimeoutWaitPolicy
+		nextWait time.Duration
+		advance  time.Duration
+		timeout  bool
+	}{
+		// wait until max delay fires
+		{PolicyWaitTimeout, time.Second, 90 * ms, true},
+		// final attempt without waiting
+		{PolicySkipWait, 0, 0, false},
+		// wait the 90ms left minus the 10ms of the last attempt
+		{PolicyClampWait, 80 * ms, 80 * ms, false},
+	}
+	for _, c := range cases {
+		clock := retryingtest.NewFakeClock(time.Now())
+		var waits []time.Duration
+		calls := 0
+		r := New().MaxAttemptTimes(2).
+			MaxDelay(100 * ms).
+			WaitFixed(time.Second).
+			TimeoutWaitPolicy(c.policy).
+			Clock(clock).
+			OnRetry(func(a Attempt) { waits = append(waits, a.NextWait) }).
+			Function(func() error {
+				calls++
+				if calls == 1 {
+					clock.Advance(10 * ms)
+					return fmt.Errorf("")
+				}
+				return nil
+			})
+
+		done := make(chan error, 1)
+		go func() { done <- r.Try() }()
+		if c.advance > 0 {
+			// max delay and the wait are pending
+			clock.BlockUntil(2)
+			clock.Advance(c.advance)
+		}
+		err := <-done
+		if errors.Is(err, ErrTimeout) != c.timeout {
+			t.Errorf("timeout of policy %v should be %v but get %v", c.policy, c.timeout, err)
+		}
+		if len(waits) != 1 || waits[0] != c.nextWait {
+			t.Errorf("wait of policy %v should be %v but get %v", c.policy, c.nextWait, waits)
+		}
+	}
+
+	// a single final attempt follows the fitted wait
+	for _, policy := range []TimeoutWaitPolicy{PolicySkipWait, PolicyClampWait} {
+		var calls int32
+		err := New().MaxAttemptTimes(1000).
+			MaxDelay(200 * ms).
+			WaitFixed(time.Second).
+			TimeoutWaitPolicy(policy).
+			Func(func() error {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(20 * ms)
+				return fmt.Errorf("")
+			}).Try()
+		if calls := atomic.LoadInt32(&calls); calls != 2 || (policy == PolicySkipWait && errors.Is(err, ErrTimeout)) {
+			t.Errorf("policy %v should stop after 2 calls but get %v calls with %v", policy, calls, err)
+		}
+	}
+}
+
+func TestNoAttemptAfterTimeout(t *testing.T) {
+	// attempt 0-30ms and wait 30-60ms straddle the 50ms deadline
+	var calls int32
+	err := New().MaxAttemptTimes(5).
+		MaxDelay(time.Millisecond * 50).
+		WaitFixed(time.Millisecond * 30).
+		Function(func() error {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(time.Millisecond * 30)
+			return fmt.Errorf("")
+		}).
+		Try()
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("error should be %v but get %v", ErrTimeout, err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("function should be called once but get %v", n)
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	c := 0
+	start := time.Now()
+	err := New().MaxAttemptTimes(5).
+		MaxDelay(time.Millisecond * 100).
+		Function(func() error {
+			c++
+			if c < 3 {
+				return fmt.Errorf("")
+			}
+			time.Sleep(time.Millisecond * 200)
+			return nil
+		}).
+		Try()
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("error should be %v but get %v", ErrTimeout, err)
+	}
+	var te *TimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("error should contain a timeout error but get %v", err)
+	}
+	if te.Attempts != 2 {
+		t.Errorf("attempts should be 2 but get %v", te.Attempts)
+	}
+	if te.Elapsed < time.Millisecond*100 || te.Elapsed > elapsed {
+		t.Errorf("elapsed should be in [100ms, %v] but get %v", elapsed, te.Elapsed)
+	}
+}
+
+func TestTimedOut(t *testing.T) {
+	// timeout
+	r1 := New().MaxAttemptTimes(3).
+		MaxDelay(time.Millisecond * 20).
+		Function(func() error {
+			time.Sleep(time.Millisecond * 50)
+			return nil
+		})
+	if err := r1.Try(); err == nil || !r1.TimedOut() {
+		t.Errorf("try should time out but get %v", err)
+	}
+
+	// attempts exhausted
+	r2 := New().MaxAttemptTimes(3).
+		MaxDelay(time.Minute).
+		Function(func() error {
+			return fmt.Errorf("")
+		})
+	if err := r2.Try(); err == nil || r2.TimedOut() {
+		t.Errorf("try should fail without timeout but get %v", err)
+	}
+
+	// reset by the next try
+	r1.Function(func() error { return nil })
+	if err := r1.Try(); err != nil || r1.TimedOut() {
+		t.Errorf("try should succeed without timeout but get %v", err)
+	}
+}
+
+func TestStopAfterRepeatedError(t *testing.T) {
+	r := New().StopAfterRepeatedError(0)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidStopAfterRepeatedError) {
+		t.Errorf("error should be %v but get %v", ErrInvalidStopAfterRepeatedError, r.errors[0])
+	}
+
+	errSame, errOther := fmt.Errorf("same"), fmt.Errorf("other")
+
+	// the same sentinel repeats
+	c1 := 0
+	if err := New().MaxAttemptTimes(100).StopAfterRepeatedError(3).Function(func() error {
+		c1++
+		return fmt.Errorf("wrapped: %w", errSame)
+	}).Try(); !errors.Is(err, errSame) || c1 != 3 {
+		t.Errorf("function should fail 3 times but get %v calls with %v", c1, err)
+	}
+
+	// a different error restarts the count
+	c2 := 0
+	errs := []error{errSame, errSame, errOther, errSame, errSame, errSame}
+	if err := New().MaxAttemptTimes(100).StopAfterRepeatedError(3).Function(func() error {
+		c2++
+		return errs[c2-1]
+	}).Try(); err == nil || c2 != 6 {
+		t.Errorf("function should fail 6 times but get %v calls with %v", c2, err)
+	}
+}
+
+func TestMaxElapsedTime(t *testing.T) {
+	r := New().MaxElapsedTime(time.Duration(0))
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidMaxElapsedTime) {
+		t.Errorf("error should be %v but get %v", ErrInvalidMaxElapsedTime, r.errors[0])
+	}
+
+	for _, maxDelay := range []time.Duration{0, time.Minute} {
+		// attempts first
+		c1 := 0
+		r1 := New().MaxAttemptTimes(3).
+			MaxElapsedTime(time.Minute).
+			Function(func() error {
+				c1++
+				return fmt.Errorf("")
+			})
+		if maxDelay > 0 {
+			r1.MaxDelay(maxDelay)
+		}
+		if err := r1.Try(); err == nil || c1 != 3 {
+			t.Errorf("function should fail 3 times but get %v calls with %v", c1, err)
+		}
+
+		// time first
+		c2 := 0
+		r2 := New().MaxAttemptTimes(100).
+			MaxElapsedTime(time.Millisecond * 50).
+			WaitFixed(time.Millisecond * 10).
+			Function(func() error {
+				c2++
+				return fmt.Errorf("")
+			})
+		if maxDelay > 0 {
+			r2.MaxDelay(maxDelay)
+		}
+		start := time.Now()
+		err := r2.Try()
+		if err == nil || errors.Is(err, ErrTimeout) {
+			t.Errorf("error should be attempt errors but get %v", err)
+		}
+		if c2 >= 100 {
+			t.Errorf("function should be called within 50ms but get %v calls", c2)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("should return around 50ms but get %v", elapsed)
+		}
+	}
+
+	// a running attempt is not interrupted
+	finished := false
+	if err := New().MaxAttemptTimes(2).
+		MaxElapsedTime(time.Millisecond * 10).
+		Function(func() error {
+			time.Sleep(time.Millisecond * 50)
+			finished = true
+			return fmt.Errorf("")
+		}).
+		Try(); err == nil || !finished {
+		t.Errorf("attempt should finish but get %v", err)
+	}
+}
+
+func TestMaxTotalWait(t *testing.T) {
+	r := New().MaxTotalWait(time.Duration(0))
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidMaxTotalWait) {
+		t.Errorf("error should be %v but get %v", ErrInvalidMaxTotalWait, r.errors[0])
+	}
+
+	// 3 waits of 20ms fit in 70ms, attempts are never interrupted
+	c, finished := 0, 0
+	err := New().MaxAttemptTimes(10).
+		WaitFixed(time.Millisecond * 20).
+		MaxTotalWait(time.Millisecond * 70).
+		Function(func() error {
+			c++
+			time.Sleep(time.Millisecond * 30)
+			finished++
+			return fmt.Errorf("")
+		}).
+		Try()
+	if merr, ok := err.(*multierror.Error); !ok || len(merr.Errors) != 4 {
+		t.Errorf("number of errors should be 4 but get %v", err)
+	}
+	if c != 4 || finished != 4 {
+		t.Errorf("4 attempts should finish but get %v finished in %v calls", finished, c)
+	}
+}
+
+func TestWaitFixed(t *testing.T) {
+	r := New().WaitFixed(time.Duration(0))
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidWaitFixed) {
+		t.Errorf("error should be %v but get %v", ErrInvalidWaitFixed, r.errors[0])
+	}
+}
+
+func TestNoWait(t *testing.T) {
+	slept := 0
+	defer func(s func(time.Duration)) { sleep = s }(sleep)
+	sleep = func(time.Duration) { slept++ }
+
+	c := 0
+	r := New().MaxAttemptTimes(3).
+		WaitFixed(time.Minute).
+		NoWait().
+		Function(func() error {
+			c++
+			return fmt.Errorf("")
+		})
+	if len(r.errors) != 0 {
+		t.Errorf("number of errors should be 0 but get %v", len(r.errors))
+	}
+	if err := r.Try(); err == nil || c != 3 || slept != 0 {
+		t.Errorf("function should fail 3 times without sleeping but get %v calls and %v sleeps with %v", c, slept, err)
+	}
+}
+
+func TestWaitRandom(t *testing.T) {
+	r1 := New().WaitRandom(time.Duration(-1), time.Second)
+	if len(r1.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+
+	r2 := New().WaitRandom(time.Minute, time.Second)
+	if len(r2.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+
+	r3 := New().WaitRandom(time.Duration(-1), time.Duration(-2))
+	if len(r3.errors) != 2 {
+		t.Error("number of errors should be 2")
+	}
+
+	// min equal to max is a fixed wait
+	r4 := New().WaitRandom(time.Second, time.Second)
+	if len(r4.errors) != 0 {
+		t.Errorf("number of errors should be 0 but get %v", r4.errors)
+	}
+	if d := r4.waitDuration(1, nil); d != time.Second {
+		t.Errorf("wait should be 1s but get %v", d)
+	}
+	for _, err := range append(r1.errors, r3.errors...) {
+		if !errors.Is(err, ErrInvalidWaitRandom) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitRandom, err)
+		}
+	}
+}
+
+func TestStopChan(t *testing.T) {
+	r := New().StopChan(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidStopChan) {
+		t.Errorf("error should be %v but get %v", ErrInvalidStopChan, r.errors[0])
+	}
+
+	for _, maxDelay := range []time.Duration{0, time.Minute} {
+		stop := make(chan struct{})
+		errFail := fmt.Errorf("fail")
+		r := New().MaxAttemptTimes(100).
+			WaitFixed(time.Minute).
+			StopChan(stop).
+			Function(func() error { return errFail })
+		if maxDelay > 0 {
+			r.MaxDelay(maxDelay)
+		}
+
+		time.AfterFunc(time.Millisecond*50, func() { close(stop) })
+		start := time.Now()
+		err := r.Try()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("should return around 50ms but get %v", elapsed)
+		}
+		if !errors.Is(err, ErrStopped) || !errors.Is(err, errFail) {
+			t.Errorf("error should contain stopped and attempt error but get %v", err)
+		}
+	}
+}
+
+func TestGate(t *testing.T) {
+	r := New().Gate(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidGate) {
+		t.Errorf("error should be %v but get %v", ErrInvalidGate, r.errors[0])
+	}
+
+	// step through attempts one at a time
+	gate := make(chan struct{})
+	calls := make(chan int, 3)
+	c := 0
+	done := New().MaxAttemptTimes(3).Gate(gate).Function(func() error {
+		c++
+		calls <- c
+		return fmt.Errorf("")
+	}).TryAsync()
+	for i := 1; i <= 3; i++ {
+		if n := <-calls; n != i {
+			t.Errorf("attempt should be %v but get %v", i, n)
+		}
+		select {
+		case n := <-calls:
+			t.Fatalf("attempt %v should be held by the gate", n)
+		case <-time.After(time.Millisecond * 20):
+		}
+		if i < 3 {
+			gate <- struct{}{}
+		}
+	}
+	if err := <-done; err == nil {
+		t.Error("error should not be nil")
+	}
+
+	// ctx interrupts the hold
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	err := New().MaxAttemptTimes(3).Gate(make(chan struct{})).Function(func() error {
+		return fmt.Errorf("")
+	}).TryContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error should be %v but get %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRetryOn(t *testing.T) {
+	r := New().RetryOn()
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidRetryOn) {
+		t.Errorf("error should be %v but get %v", ErrInvalidRetryOn, r.errors[0])
+	}
+
+	errTransient, errFatal := fmt.Errorf("transient"), fmt.Errorf("fatal")
+
+	// retry wrapped transient errors until a fatal one
+	c := 0
+	err := New().MaxAttemptTimes(5).
+		RetryOn(errTransient).
+		Function(func() error {
+			c++
+			if c < 3 {
+				return fmt.Errorf("wrapped: %w", errTransient)
+			}
+			return errFatal
+		}).
+		Try()
+	if c != 3 || !errors.Is(err, errFatal) {
+		t.Errorf("function should stop after 3 calls with fatal error but get %v calls with %v", c, err)
+	}
+}
+
+func TestAbortOn(t *testing.T) {
+	r := New().AbortOn()
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidAbortOn) {
+		t.Errorf("error should be %v but get %v", ErrInvalidAbortOn, r.errors[0])
+	}
+
+	errTransient, errFatal := fmt.Errorf("transient"), fmt.Errorf("fatal")
+
+	// abort on a wrapped fatal error
+	c1 := 0
+	err := New().MaxAttemptTimes(5).
+		AbortOn(errFatal).
+		Function(func() error {
+			c1++
+			if c1 < 2 {
+				return errTransient
+			}
+			return fmt.Errorf("wrapped: %w", errFatal)
+		}).
+		Try()
+	if c1 != 2 || !errors.Is(err, errFatal) {
+		t.Errorf("function should stop after 2 calls with fatal error but get %v calls with %v", c1, err)
+	}
+
+	// abort on takes precedence over retry on
+	c2 := 0
+	New().MaxAttemptTimes(5).
+		RetryOn(errFatal).
+		AbortOn(errFatal).
+		Function(func() error {
+			c2++
+			return errFatal
+		}).
+		Try()
+	if c2 != 1 {
+		t.Errorf("function should be called once but get %v", c2)
+	}
+}
+
+func TestUntil(t *testing.T) {
+	r := New().Until(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidCallback) {
+		t.Errorf("error should be %v but get %v", ErrInvalidCallback, r.errors[0])
+	}
+
+	// the condition flips on the third check
+	calls, checks := 0, 0
+	err := New().MaxAttemptTimes(5).
+		Until(func() bool {
+			checks++
+			return checks == 3
+		}).
+		Function(func() error {
+			calls++
+			return nil
+		}).
+		Try()
+	if err != nil || calls != 3 || checks != 3 {
+		t.Errorf("try should succeed after 3 calls and checks but get %v calls and %v checks with %v", calls, checks, err)
+	}
+
+	// never met
+	err = New().MaxAttemptTimes(2).Until(func() bool { return false }).Function(func() error { return nil }).Try()
+	if !errors.Is(err, ErrConditionNotMet) {
+		t.Errorf("error should be %v but get %v", ErrConditionNotMet, err)
+	}
+
+	// not checked after failed calls
+	checks = 0
+	New().MaxAttemptTimes(2).
+		Until(func() bool { checks++; return true }).
+		Function(func() error { return fmt.Errorf("") }).
+		Try()
+	if checks != 0 {
+		t.Errorf("condition should not be checked but get %v checks", checks)
+	}
+
+	// error filters, classifiers and repeat limits never apply to the unmet condition
+	errFail := errors.New("fail")
+	for _, r := range []*Retryable{
+		New().RetryOn(errFail),
+		New().AbortOn(ErrConditionNotMet),
+		New().SuccessOn(ErrConditionNotMet),
+		New().Classify(func(error) Action { return ActionFail }),
+		New().StopAfterRepeatedError(2),
+	} {
+		checks = 0
+		err = r.MaxAttemptTimes(5).
+			Until(func() bool {
+				checks++
+				return checks == 3
+			}).
+			Function(func() error { return nil }).
+			Try()
+		if err != nil || checks != 3 {
+			t.Errorf("try should succeed after 3 checks but get %v checks with %v", checks, err)
+		}
+	}
+}
+
+func TestSuccessOn(t *testing.T) {
+	r := New().SuccessOn()
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidSuccessOn) {
+		t.Errorf("error should be %v but get %v", ErrInvalidSuccessOn, r.errors[0])
+	}
+
+	c := 0
+	err := New().MaxAttemptTimes(5).SuccessOn(io.EOF).Function(func() error {
+		c++
+		if c == 3 {
+			return fmt.Errorf("page 3: %w", io.EOF)
+		}
+		return fmt.Errorf("")
+	}).Try()
+	if err != nil || c != 3 {
+		t.Errorf("function should succeed after 3 calls but get %v calls with %v", c, err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	r := New().Classify(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidCallback) {
+		t.Errorf("error should be %v but get %v", ErrInvalidCallback, r.errors[0])
+	}
+
+	errTransient, errFatal, errNotFound := fmt.Errorf("transient"), fmt.Errorf("fatal"), fmt.Errorf("not found")
+	classify := func(err error) Action {
+		switch {
+		case errors.Is(err, errFatal):
+			return ActionFail
+		case errors.Is(err, errNotFound):
+			return ActionSucceed
+		}
+		return ActionRetry
+	}
+	cases := []struct {
+		errs     []error
+		calls    int
+		expected error
+	}{
+		// retry until the attempts are exhausted
+		{[]error{errTransient, errTransient, errTransient, errTransient}, 3, errTransient},
+		// fail on the second attempt
+		{[]error{errTransient, errFatal, errTransient}, 2, errFatal},
+		// accepted on the second attempt
+		{[]error{errTransient, errNotFound, errTransient}, 2, nil},
+	}
+	for _, c := range cases {
+		calls := 0
+		err := New().MaxAttemptTimes(3).Classify(classify).Function(func() error {
+			calls++
+			return c.errs[calls-1]
+		}).Try()
+		if calls != c.calls || (c.expected == nil) != (err == nil) || !errors.Is(err, c.expected) {
+			t.Errorf("error should be %v after %v calls but get %v after %v calls", c.expected, c.calls, err, calls)
+		}
+	}
+}
+func TestPanicHandler(t *testing.T) {
+	r := New().PanicHandler(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidCallback) {
+		t.Errorf("error should be %v but get %v", ErrInvalidCallback, r.errors[0])
+	}
+
+	errPanic := fmt.Errorf("panic error")
+	var stack []byte
+	err := New().
+		PanicHandler(func(recovered interface{}, s []byte) error {
+			stack = s
+			return recovered.(error)
+		}).
+		Function(func() { panic(errPanic) }).
+		Try()
+	if merr, ok := err.(*multierror.Error); !ok || len(merr.Errors) != 1 || merr.Errors[0] != errPanic {
+		t.Errorf("error should be the panic value but get %v", err)
+	}
+	if len(stack) == 0 {
+		t.Error("stack should not be empty")
+	}
+}
+
+func TestOnRetry(t *testing.T) {
+	r := New().OnRetry(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidCallback) {
+		t.Errorf("error should be %v but get %v", ErrInvalidCallback, r.errors[0])
+	}
+
+	var attempts []Attempt
+	errs := []error{fmt.Errorf("first"), fmt.Errorf("second"), fmt.Errorf("third")}
+	c := 0
+	start := time.Now()
+	if err := New().MaxAttemptTimes(3).
+		Label("req-1").
+		WaitFixed(time.Millisecond).
+		OnRetry(func(a Attempt) { attempts = append(attempts, a) }).
+		Function(func() error {
+			c++
+			return errs[c-1]
+		}).
+		Try(); err == nil {
+		t.Error("error should not be nil")
+	}
+
+	// no retry after the last attempt
+	if len(attempts) != 2 {
+		t.Fatalf("on retry should be called 2 times but get %v", len(attempts))
+	}
+	for i, a := range attempts {
+		if a.Label != "req-1" || a.Number != i+1 || a.Err != errs[i] || a.NextWait != time.Millisecond {
+			t.Errorf("attempt %v is not populated correctly: %+v", i+1, a)
+		}
+		if a.Start.Before(start) || (i > 0 && !a.Start.After(attempts[i-1].Start)) {
+			t.Errorf("start of attempt %v is not populated correctly: %v", i+1, a.Start)
+		}
+	}
+}
+
+func TestOnRetryNextWait(t *testing.T) {
+	var slept []time.Duration
+	defer func(s func(time.Duration)) { sleep = s }(sleep)
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	var reported []time.Duration
+	New().MaxAttemptTimes(6).
+		RandSource(rand.NewSource(1)).
+		WaitRandomExponential(time.Millisecond, 2).
+		OnRetry(func(a Attempt) { reported = append(reported, a.NextWait) }).
+		Function(func() error { return fmt.Errorf("") }).
+		Try()
+
+	if len(reported) != 5 || len(slept) > len(reported) {
+		t.Fatalf("on retry should be called 5 times but get %v with %v sleeps", len(reported), len(slept))
+	}
+	// zero waits are not slept
+	i := 0
+	for _, d := range reported {
+		if d == 0 {
+			continue
+		}
+		if i >= len(slept) || slept[i] != d {
+			t.Errorf("reported waits %v should be slept but get %v", reported, slept)
+			break
+		}
+		i++
+	}
+}
+
+func TestWaitComputedOnce(t *testing.T) {
+	var slept []time.Duration
+	defer func(s func(time.Duration)) { sleep = s }(sleep)
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	policy := func() *Retryable {
+		return New().MaxAttemptTimes(8).
+			RandSource(rand.NewSource(1)).
+			WaitExponentialWithJitterCap(time.Millisecond, 2, time.Microsecond*100)
+	}
+	expected := policy().Schedule(7)
+
+	var reported []time.Duration
+	policy().
+		OnRetry(func(a Attempt) { reported = append(reported, a.NextWait) }).
+		Function(func() error { return fmt.Errorf("") }).
+		Try()
+
+	// one wait per attempt in order, consuming the random source once each
+	if len(slept) != len(expected) || len(reported) != len(expected) {
+		t.Fatalf("waits should be %v but get %v slept and %v reported", expected, slept, reported)
+	}
+	for i := range expected {
+		if slept[i] != expected[i] || reported[i] != expected[i] {
+			t.Errorf("wait %v should be %v but get %v slept and %v reported", i, expected[i], slept[i], reported[i])
+		}
+		if i > 0 && slept[i] <= slept[i-1] {
+			t.Errorf("waits should grow but get %v", slept)
+		}
+	}
+}
+
+func TestBetweenAttempts(t *testing.T) {
+	r := New().BetweenAttempts(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidCallback) {
+		t.Errorf("error should be %v but get %v", ErrInvalidCallback, r.errors[0])
+	}
+
+	// cleanups allow next attempts
+	errFail := fmt.Errorf("fail")
+	var cleaned []int
+	c1 := 0
+	err := New().MaxAttemptTimes(3).
+		BetweenAttempts(func(attempt int, err error) error {
+			if err != errFail {
+				t.Errorf("error should be %v but get %v", errFail, err)
+			}
+			cleaned = append(cleaned, attempt)
+			return nil
+		}).
+		Function(func() error {
+			c1++
+			if c1 < 3 {
+				return errFail
+			}
+			return nil
+		}).
+		Try()
+	if err != nil || len(cleaned) != 2 || cleaned[0] != 1 || cleaned[1] != 2 {
+		t.Errorf("attempts 1 and 2 should be cleaned but get %v with %v", cleaned, err)
+	}
+
+	// failed cleanup aborts
+	errCleanup := fmt.Errorf("cleanup")
+	c2 := 0
+	err = New().MaxAttemptTimes(3).
+		BetweenAttempts(func(int, error) error { return errCleanup }).
+		Function(func() error {
+			c2++
+			return errFail
+		}).
+		Try()
+	if !errors.Is(err, errCleanup) || !errors.Is(err, errFail) || c2 != 1 {
+		t.Errorf("try should stop after 1 call with both errors but get %v calls with %v", c2, err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	r := New().Events(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidEvents) {
+		t.Errorf("error should be %v but get %v", ErrInvalidEvents, r.errors[0])
+	}
+
+	// drain events
+	events := make(chan Attempt, 10)
+	c := 0
+	if err := New().MaxAttemptTimes(5).
+		WaitFixed(time.Millisecond).
+		Events(events).
+		Function(func() error {
+			c++
+			if c == 3 {
+				return nil
+			}
+			return fmt.Errorf("")
+		}).
+		Try(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+
+	var attempts []Attempt
+	for len(events) > 0 {
+		attempts = append(attempts, <-events)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("number of events should be 3 but get %v", len(attempts))
+	}
+	for i, a := range attempts {
+		last := i == len(attempts)-1
+		if a.Number != i+1 || (a.Err == nil) != last {
+			t.Errorf("event %v is not populated correctly: %+v", i+1, a)
+		}
+		if (last && a.NextWait != 0) || (!last && a.NextWait != time.Millisecond) {
+			t.Errorf("next wait of event %v is not correct: %v", i+1, a.NextWait)
+		}
+	}
+
+	// slow consumer does not block retrying
+	unbuffered := make(chan Attempt)
+	if err := New().MaxAttemptTimes(3).
+		Events(unbuffered).
+		Function(func() error { return fmt.Errorf("") }).
+		Try(); err == nil {
+		t.Error("error should not be nil")
+	}
+
+	// the chan is not closed, so concurrent and repeated tries share it
+	shared := make(chan Attempt, 20)
+	r = New().MaxAttemptTimes(2).Events(shared).Func(func() error { return io.EOF })
+	clones := []*Retryable{r.Clone(), r.Clone(), r.Clone(), r.Clone()}
+	var wg sync.WaitGroup
+	for _, c := range clones {
+		wg.Add(1)
+		go func(c *Retryable) {
+			defer wg.Done()
+			c.Try()
+			r.Try()
+		}(c)
+	}
+	wg.Wait()
+	if n := len(shared); n != 16 {
+		t.Errorf("number of events should be 16 but get %v", n)
+	}
+}
+
+func TestTryEvents(t *testing.T) {
+	c := 0
+	events, errChan := New().MaxAttemptTimes(5).Func(func() error {
+		c++
+		if c == 3 {
+			return nil
+		}
+		return io.EOF
+	}).TryEvents(context.Background(), 10)
+
+	var attempts []Attempt
+	for a := range events {
+		attempts = append(attempts, a)
+	}
+	if err := <-errChan; err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+	if len(attempts) != 3 || attempts[2].Err != nil {
+		t.Errorf("events should be 3 attempts ending in success but get %+v", attempts)
+	}
+}
+
+func TestOnStart(t *testing.T) {
+	r := New().OnStart(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidCallback) {
+		t.Errorf("error should be %v but get %v", ErrInvalidCallback, r.errors[0])
+	}
+
+	for _, f := range []func() error{
+		func() error { return nil },
+		func() error { return fmt.Errorf("") },
+	} {
+		for _, n := range []int64{1, 3} {
+			starts, calls := 0, 0
+			New().MaxAttemptTimes(n).
+				OnStart(func() {
+					if calls != 0 {
+						t.Error("on start should be called before the first attempt")
+					}
+					starts++
+				}).
+				Function(func() error {
+					calls++
+					return f()
+				}).
+				Try()
+			if starts != 1 {
+				t.Errorf("on start should be called once but get %v", starts)
+			}
+		}
+	}
+}
+
+func TestOnSuccess(t *testing.T) {
+	r := New().OnSuccess(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidCallback) {
+		t.Errorf("error should be %v but get %v", ErrInvalidCallback, r.errors[0])
+	}
+
+	for _, maxDelay := range []time.Duration{0, time.Minute} {
+		var calls, attempts int
+		c := 0
+		r := New().MaxAttemptTimes(5).
+			OnSuccess(func(n int) {
+				calls++
+				attempts = n
+			}).
+			OnGiveUp(func(int, error) { t.Error("on give up should not be called") }).
+			Function(func() error {
+				c++
+				if c == 3 {
+					return nil
+				}
+				return fmt.Errorf("")
+			})
+		if maxDelay > 0 {
+			r.MaxDelay(maxDelay)
+		}
+		if err := r.Try(); err != nil {
+			t.Errorf("error should be nil but get %v", err)
+		}
+		if calls != 1 || attempts != 3 {
+			t.Errorf("on success should be called once with 3 attempts but get %v calls with %v attempts", calls, attempts)
+		}
+	}
+}
+
+func TestOnGiveUp(t *testing.T) {
+	r := New().OnGiveUp(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidCallback) {
+		t.Errorf("error should be %v but get %v", ErrInvalidCallback, r.errors[0])
+	}
+
+	for _, maxDelay := range []time.Duration{0, time.Minute} {
+		var calls, attempts int
+		var lastErr error
+		r := New().MaxAttemptTimes(3).
+			OnSuccess(func(int) { t.Error("on success should not be called") }).
+			OnGiveUp(func(n int, err error) {
+				calls++
+				attempts = n
+				lastErr = err
+			}).
+			Function(func() error { return fmt.Errorf("") })
+		if maxDelay > 0 {
+			r.MaxDelay(maxDelay)
+		}
+		err := r.Try()
+		if err == nil || err != lastErr {
+			t.Errorf("on give up should get the returned error but get %v", lastErr)
+		}
+		if calls != 1 || attempts != 3 {
+			t.Errorf("on give up should be called once with 3 attempts but get %v calls with %v attempts", calls, attempts)
+		}
+	}
+
+	// timeout
+	var attempts int
+	var lastErr error
+	New().MaxDelay(time.Millisecond * 10).
+		OnGiveUp(func(n int, err error) {
+			attempts = n
+			lastErr = err
+		}).
+		Function(func() { time.Sleep(time.Second) }).
+		Try()
+	if attempts != 1 || !errors.Is(lastErr, ErrTimeout) {
+		t.Errorf("on give up should get 1 attempt and timeout but get %v and %v", attempts, lastErr)
+	}
+}
+
+func TestFunction(t *testing.T) {
+	r1 := New().Function(1)
+	if len(r1.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+
+	r2 := New().Function(func(_ int) int { return 1 })
+	if len(r2.errors) != 2 {
+		t.Error("number of errors should be 2")
+	}
+	for _, err := range append(r1.errors, r2.errors...) {
+		if !errors.Is(err, ErrInvalidFunction) {
+			t.Errorf("error should be %v but get %v", ErrInvalidFunction, err)
+		}
+	}
+}
+
+func TestFunc(t *testing.T) {
+	r := New().Func(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidFunction) {
+		t.Errorf("error should be %v but get %v", ErrInvalidFunction, r.errors[0])
+	}
+
+	c := 0
+	var fn RetryableFunc = func() error {
+		c++
+		if c < 3 {
+			return fmt.Errorf("")
+		}
+		return nil
+	}
+	if err := New().MaxAttemptTimes(5).Func(fn).Try(); err != nil || c != 3 {
+		t.Errorf("function should succeed after 3 calls but get %v calls with %v", c, err)
+	}
+
+	// panics are recovered
+	err := New().Func(func() error { panic("boom") }).Try()
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("error should contain the panic but get %v", err)
+	}
+}
+
+func BenchmarkFunction(b *testing.B) {
+	r := New().Function(func() error { return nil })
+	for i := 0; i < b.N; i++ {
+		r.Try()
+	}
+}
+
+func BenchmarkFunc(b *testing.B) {
+	r := New().Func(func() error { return nil })
+	for i := 0; i < b.N; i++ {
+		r.Try()
+	}
+}
+
+func BenchmarkTrySuccess(b *testing.B) {
+	r := New().Func(func() error { return nil })
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Try()
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	defer func() {
+		if e := recover(); e != "boom" {
+			t.Errorf("panic should propagate but get %v", e)
+		}
+	}()
+	New().RecoverPanics(false).Func(func() error { panic("boom") }).Try()
+	t.Error("try should panic")
+}
+
+func BenchmarkRecoverPanics(b *testing.B) {
+	for _, enabled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("recover=%v", enabled), func(b *testing.B) {
+			r := New().RecoverPanics(enabled).Func(func() error { return nil })
+			for i := 0; i < b.N; i++ {
+				r.Try()
+			}
+		})
+	}
+}
+
+func TestRetryRuntimePanics(t *testing.T) {
+	calls := 0
+	f := func() error {
+		calls++
+		var s []int
+		return fmt.Errorf("%v", s[calls])
+	}
+
+	// runtime panics stop immediately by default
+	err := New().MaxAttemptTimes(3).Func(f).Try()
+	var re runtime.Error
+	if !errors.As(err, &re) || calls != 1 {
+		t.Errorf("error should be runtime error after 1 call but get %v after %v calls", err, calls)
+	}
+
+	// the panic handler receives the runtime error
+	calls = 0
+	var recovered interface{}
+	New().MaxAttemptTimes(3).PanicHandler(func(e interface{}, _ []byte) error {
+		recovered = e
+		return fmt.Errorf("%v", e)
+	}).Func(f).Try()
+	if _, ok := recovered.(runtime.Error); !ok || calls != 1 {
+		t.Errorf("recovered should be runtime error after 1 call but get %T after %v calls", recovered, calls)
+	}
+
+	// retried if configured
+	calls = 0
+	if err := New().MaxAttemptTimes(3).RetryRuntimePanics(true).Func(f).Try(); !errors.As(err, &re) || calls != 3 {
+		t.Errorf("error should be runtime error after 3 calls but get %v after %v calls", err, calls)
+	}
+
+	// user panics are retried
+	calls = 0
+	New().MaxAttemptTimes(3).Func(func() error {
+		calls++
+		panic("retry me")
+	}).Try()
+	if calls != 3 {
+		t.Errorf("calls should be 3 but get %v", calls)
+	}
+}
+
+func TestPanicError(t *testing.T) {
+	err := New().Function(func() { panic(valueError{msg: "boom"}) }).Try()
+	var ve valueError
+	if !errors.As(err, &ve) || ve.msg != "boom" {
+		t.Errorf("error should unwrap to the panicked error but get %v", err)
+	}
+	if !strings.Contains(err.Error(), "goroutine") {
+		t.Errorf("error should contain the stack but get %v", err)
+	}
+}
+
+func TestFunctionContext(t *testing.T) {
+	r := New().FunctionContext(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+
+	// context functions passed to Function are pointed to FunctionContext
+	for _, f := range []interface{}{
+		func(context.Context) error { return nil },
+		func(context.Context) {},
+	} {
+		r := New().Function(f)
+		if len(r.errors) != 1 {
+			t.Fatal("number of errors should be 1")
+		}
+		if err := r.errors[0]; !errors.Is(err, ErrInvalidFunction) || !strings.Contains(err.Error(), "use FunctionContext") {
+			t.Errorf("error should point to FunctionContext but get %v", err)
+		}
+	}
+
+	// the attempt context is done when max delay is reached
+	err := New().MaxAttemptTimes(3).MaxDelay(time.Millisecond * 20).FunctionContext(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}).Try()
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("error should be %v but get %v", ErrTimeout, err)
+	}
+
+	// values of the try context are passed
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "v")
+	var got interface{}
+	if err := New().FunctionContext(func(ctx context.Context) error {
+		got = ctx.Value(key{})
+		return nil
+	}).TryContext(ctx); err != nil || got != "v" {
+		t.Errorf("context value should be v but get %v with %v", got, err)
+	}
+}
+
+func TestDrainOnTimeout(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// the interrupted attempt has returned once the try returns
+	var exited int32
+	stop := make(chan struct{})
+	defer close(stop)
+	err := New().MaxAttemptTimes(3).MaxDelay(time.Millisecond * 20).StopChan(stop).DrainOnTimeout(true).
+		FunctionContext(func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(time.Millisecond * 20)
+			atomic.StoreInt32(&exited, 1)
+			return ctx.Err()
+		}).Try()
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("error should be %v but get %v", ErrTimeout, err)
+	}
+	if atomic.LoadInt32(&exited) != 1 {
+		t.Error("attempt should have returned")
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("goroutines should not leak but get %v after %v", n, before)
+	}
+
+	// the watcher of a fake clock is joined as well
+	clock := retryingtest.NewFakeClock(time.Now())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+	}()
+	err = New().Clock(clock).MaxDelay(time.Second).DrainOnTimeout(true).FunctionContext(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}).Try()
+	<-done
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("error should be %v but get %v", ErrTimeout, err)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("goroutines should not leak but get %v after %v", n, before)
+	}
+
+	// by default attempts ignoring ctx do not hold the try
+	start := time.Now()
+	if err := New().MaxDelay(time.Millisecond * 10).Func(func() error {
+		time.Sleep(time.Millisecond * 200)
+		return nil
+	}).Try(); !errors.Is(err, ErrTimeout) || time.Since(start) > time.Millisecond*100 {
+		t.Errorf("try should time out around 10ms but get %v after %v", err, time.Since(start))
+	}
+
+	// drained the try returns once they do
+	start = time.Now()
+	if err := New().MaxDelay(time.Millisecond * 10).DrainOnTimeout(true).Func(func() error {
+		time.Sleep(time.Millisecond * 50)
+		return nil
+	}).Try(); !errors.Is(err, ErrTimeout) || time.Since(start) < time.Millisecond*50 {
+		t.Errorf("try should time out once the attempt returns but get %v after %v", err, time.Since(start))
+	}
+}
+
+func TestFunctionAttempt(t *testing.T) {
+	r := New().FunctionAttempt(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+
+	var got [][2]int
+	err := New().MaxAttemptTimes(3).FunctionAttempt(func(attempt, remaining int) error {
+		got = append(got, [2]int{attempt, remaining})
+		if remaining > 0 {
+			return fmt.Errorf("")
+		}
+		return nil
+	}).Try()
+	expected := [][2]int{{1, 2}, {2, 1}, {3, 0}}
+	if err != nil || len(got) != len(expected) {
+		t.Fatalf("function should succeed on the last attempt but get %v with %v", got, err)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("attempt and remaining should be %v but get %v", expected[i], got[i])
+		}
+	}
+
+	// large budgets of attempts stay in range of int
+	want := int64(math.MaxInt64 - 1)
+	if want > math.MaxInt {
+		want = math.MaxInt
+	}
+	New().MaxAttemptTimes(math.MaxInt64).FunctionAttempt(func(attempt, remaining int) error {
+		if int64(remaining) != want {
+			t.Errorf("remaining should be %v but get %v", want, remaining)
+		}
+		return nil
+	}).Try()
+
+	// readable from the context of FunctionContext
+	New().FunctionContext(func(ctx context.Context) error {
+		if attempt, remaining, ok := AttemptFromContext(ctx); !ok || attempt != 1 || remaining != 0 {
+			t.Errorf("attempt should be 1 with 0 remaining but get %v %v %v", attempt, remaining, ok)
+		}
+		return nil
+	}).Try()
+	if _, _, ok := AttemptFromContext(context.Background()); ok {
+		t.Error("attempt should not be found in a background context")
+	}
+}
+
+func TestFunctionNil(t *testing.T) {
+	var f func() error
+	for _, i := range []interface{}{nil, f} {
+		c := 0
+		r := New().Function(i).PanicHandler(func(interface{}, []byte) error {
+			c++
+			return fmt.Errorf("")
+		})
+		if len(r.errors) != 1 {
+			t.Error("number of errors should be 1")
+		}
+		if err := r.Try(); !errors.Is(err, ErrInvalidFunction) || c != 0 {
+			t.Errorf("error should be %v without panics but get %v after %v panics", ErrInvalidFunction, err, c)
+		}
+	}
+}
+
+type valueError struct{ msg string }
+
+func (e valueError) Error() string { return e.msg }
+
+func TestFunctionReturningValueError(t *testing.T) {
+	c := 0
+	err := New().MaxAttemptTimes(2).Function(func() valueError {
+		c++
+		return valueError{msg: "value error"}
+	}).Try()
+	var target valueError
+	if !errors.As(err, &target) || target.msg != "value error" || c != 2 {
+		t.Errorf("error should be value error after 2 calls but get %v calls with %v", c, err)
+	}
+
+	// nil pointer error is success
+	if err := New().Function(func() *RetryAfterError { return nil }).Try(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+}
+
+type pinger struct{ pings int }
+
+func (p *pinger) Ping() error {
+	p.pings++
+	return nil
+}
+
+func TestFunctionMethod(t *testing.T) {
+	// bound method value
+	p := &pinger{}
+	if err := New().Function(p.Ping).Try(); err != nil || p.pings != 1 {
+		t.Errorf("method should be called once but get %v calls with %v", p.pings, err)
+	}
+
+	// unbound method expression
+	r := New().Function((*pinger).Ping)
+	if len(r.errors) != 1 {
+		t.Fatalf("number of errors should be 1 but get %v", r.errors)
+	}
+	if msg := r.errors[0].Error(); !errors.Is(r.errors[0], ErrInvalidFunction) || !strings.Contains(msg, "unbound method expression") || !strings.Contains(msg, "x.Ping") {
+		t.Errorf("error should suggest a bound method value but get %v", msg)
+	}
+
+	// func with one input is not a method expression
+	if r := New().Function(func(int) {}); len(r.errors) != 1 || strings.Contains(r.errors[0].Error(), "method") {
+		t.Errorf("error should be about inputs but get %v", r.errors)
+	}
+}
+
+func TestFunctionReturningBool(t *testing.T) {
+	type ok bool
+	if r := New().Function(func() (int, ok) { return 0, true }); len(r.errors) != 0 {
+		t.Errorf("number of errors should be 0 but get %v", r.errors)
+	}
+
+	// succeed after two false
+	c1 := 0
+	if err := New().MaxAttemptTimes(5).Function(func() bool {
+		c1++
+		return c1 == 3
+	}).Try(); err != nil || c1 != 3 {
+		t.Errorf("function should succeed after 3 calls but get %v calls with %v", c1, err)
+	}
+
+	// false on all attempts
+	err := New().MaxAttemptTimes(2).Function(func() bool { return false }).Try()
+	if merr, ok := err.(*multierror.Error); !ok || len(merr.Errors) != 2 || !errors.Is(err, ErrReturnedFalse) {
+		t.Errorf("error should be 2 returned false but get %v", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	r := New().MaxAttemptTimes(-1)
+	c := r.Clone().WaitFixed(0)
+	if len(r.errors) != 1 || len(c.errors) != 2 {
+		t.Errorf("number of errors should be 1 and 2 but get %v and %v", len(r.errors), len(c.errors))
+	}
+
+	// error filters of clones never share backing arrays, even with spare capacity
+	errA, errB, errC := errors.New("a"), errors.New("b"), errors.New("c")
+	d := New()
+	for i := 0; i < 3; i++ {
+		d.RetryOn(errA).AbortOn(errA).SuccessOn(errA)
+	}
+	SetDefault(d)
+	defer SetDefault(nil)
+	c1 := Default().RetryOn(errB).AbortOn(errB).SuccessOn(errB)
+	Default().RetryOn(errC).AbortOn(errC).SuccessOn(errC)
+	d.Clone().RetryOn(errC).AbortOn(errC).SuccessOn(errC)
+	for _, filters := range [][]error{c1.retryOn, c1.abortOn, c1.successOn} {
+		if len(filters) != 4 || filters[3] != errB {
+			t.Errorf("filters of a clone should end with %v but get %v", errB, filters)
+		}
+	}
+	if len(d.retryOn) != 3 || len(Default().retryOn) != 3 {
+		t.Errorf("filters should not be changed by clones but get %v and %v", d.retryOn, Default().retryOn)
+	}
+
+	// clones do not inherit the last try and can be made while it runs
+	p := New().MaxAttemptTimes(2).MaxDelay(time.Millisecond * 20).Func(func() error {
+		time.Sleep(time.Millisecond * 15)
+		return errA
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Try()
+	}()
+	for i := 0; i < 10; i++ {
+		p.Clone()
+		time.Sleep(time.Millisecond * 3)
+	}
+	<-done
+	if len(p.Errors()) != 1 || !p.TimedOut() {
+		t.Errorf("try should time out after 1 error but get %v", p.Errors())
+	}
+	if fresh := p.Clone(); len(fresh.Errors()) != 0 || fresh.TimedOut() {
+		t.Errorf("clone should not have run but get %v", fresh.Errors())
+	}
+
+	// wait options set on a clone apply to the wait strategy it copied
+	w := New().WaitRandomExponential(time.Millisecond*100, 2)
+	s1 := w.Clone().RandSource(rand.NewSource(1)).Schedule(3)
+	s2 := w.Clone().RandSource(rand.NewSource(1)).Schedule(3)
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			t.Errorf("schedules of clones with the same source should be equal but get %v and %v", s1, s2)
+			break
+		}
+	}
+	if d := New().WaitFixedJitter(time.Second, time.Millisecond*500).Clone().JitterFirst(false).Schedule(3)[0]; d != time.Second {
+		t.Errorf("first wait should be 1s but get %v", d)
+	}
+	if d := New().WaitRandomExponential(time.Second, 2).Clone().MaxInterval(time.Millisecond).JitterFirst(false).Schedule(1)[0]; d != time.Millisecond {
+		t.Errorf("first wait should be capped to 1ms but get %v", d)
+	}
 }
 
-func TestMaxAttemptTimes(t *testing.T) {
-	r := New().MaxAttemptTimes(-1)
-	if len(r.errors) != 1 {
-		t.Error("number of errors should be 1")
+func TestValidate(t *testing.T) {
+	if err := New().Validate(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+
+	called := false
+	err := New().MaxAttemptTimes(-1).WaitFixed(0).Function(func() { called = true }).Validate()
+	if merr, ok := err.(*multierror.Error); !ok || len(merr.Errors) != 2 {
+		t.Errorf("number of errors should be 2 but get %v", err)
+	}
+	if called {
+		t.Error("function should not be called")
 	}
 }
 
-func TestMaxDelay(t *testing.T) {
-	r := New().MaxDelay(time.Duration(0))
-	if len(r.errors) != 1 {
-		t.Error("number of errors should be 1")
+func TestLenientConfig(t *testing.T) {
+	errFail := errors.New("fail")
+	attempts := 0
+	f := func() error {
+		attempts++
+		return errFail
+	}
+
+	// strict by default, the function is not called
+	r := New().MaxAttemptTimes(-1).WaitFixed(0).Function(f)
+	if err := r.Try(); !errors.Is(err, ErrInvalidMaxAttempts) || !errors.Is(err, ErrInvalidWaitFixed) || attempts != 0 {
+		t.Errorf("error should be init errors without attempts but get %v after %v attempts", err, attempts)
+	}
+	if errs := r.Errors(); len(errs) != 0 {
+		t.Errorf("errors should be empty but get %v", errs)
+	}
+
+	// lenient config drops invalid values back to defaults
+	r = New().MaxAttemptTimes(2).MaxAttemptTimes(-1).WaitRandom(time.Second, 0).Function(f).LenientConfig(true)
+	attempts = 0
+	start := time.Now()
+	err := r.Try()
+	if !errors.Is(err, errFail) || errors.Is(err, ErrInvalidMaxAttempts) {
+		t.Errorf("error should be errors of attempts but get %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts should be 2 but get %v", attempts)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("invalid wait should not be applied but get %v", elapsed)
+	}
+	if err := r.Validate(); !errors.Is(err, ErrInvalidMaxAttempts) || !errors.Is(err, ErrInvalidWaitRandom) {
+		t.Errorf("error should be init errors but get %v", err)
+	}
+	errs := r.Errors()
+	if len(errs) != 4 || !errors.Is(errs[0], ErrInvalidMaxAttempts) || !errors.Is(errs[1], ErrInvalidWaitRandom) || errs[3] != errFail {
+		t.Errorf("errors should be init errors followed by 2 failed attempts but get %v", errs)
+	}
+
+	// invalid function keeps the default
+	if err := New().Function(1).LenientConfig(true).Try(); !errors.Is(err, ErrNoFunctionSpecified) {
+		t.Errorf("error should be %v but get %v", ErrNoFunctionSpecified, err)
 	}
 }
 
-func TestWaitFixed(t *testing.T) {
-	r := New().WaitFixed(time.Duration(0))
-	if len(r.errors) != 1 {
-		t.Error("number of errors should be 1")
+func TestMaxErrorMessageLen(t *testing.T) {
+	r := New().MaxErrorMessageLen(0)
+	if len(r.errors) != 1 || !errors.Is(r.errors[0], ErrInvalidMaxErrorMessageLen) {
+		t.Errorf("error should be %v but get %v", ErrInvalidMaxErrorMessageLen, r.errors)
+	}
+
+	verbose := errors.New(strings.Repeat("verbose ", 50))
+	r = New().MaxAttemptTimes(100).MaxErrorMessageLen(80).Func(func() error { return verbose })
+	err := r.Try()
+	if msg := err.Error(); len(msg) != 80 || !strings.HasSuffix(msg, "...") {
+		t.Errorf("message should be cut to 80 bytes but get %v bytes", len(msg))
+	}
+	if !errors.Is(err, verbose) {
+		t.Errorf("error should be %v but get %v", verbose, err)
+	}
+	if errs := r.Errors(); len(errs) != 100 {
+		t.Errorf("errors should be 100 but get %v", len(errs))
+	}
+
+	// multi-byte messages are cut by bytes on a rune boundary
+	wide := errors.New(strings.Repeat("é", 50))
+	for _, n := range []int{2, 10, 11} {
+		msg := New().MaxErrorMessageLen(n).Func(func() error { return wide }).Try().Error()
+		if len(msg) > n || !utf8.ValidString(msg) {
+			t.Errorf("message should be valid utf-8 within %v bytes but get %q", n, msg)
+		}
+	}
+
+	// short messages are kept
+	if err := New().MaxErrorMessageLen(80).Func(func() error { return io.EOF }).Try(); err.Error() != multierror.Append(nil, io.EOF).Error() {
+		t.Errorf("message should be kept but get %q", err.Error())
 	}
 }
 
-func TestWaitRandom(t *testing.T) {
-	r1 := New().WaitRandom(time.Duration(-1), time.Second)
-	if len(r1.errors) != 1 {
-		t.Error("number of errors should be 1")
+func TestRun(t *testing.T) {
+	errFail := errors.New("fail")
+	calls, succeedAt := 0, 5
+	inner := New().MaxAttemptTimes(3).Func(func() error {
+		calls++
+		if calls == succeedAt {
+			return nil
+		}
+		return errFail
+	})
+
+	// the outer retry runs the inner one until it succeeds
+	if err := New().MaxAttemptTimes(5).Func(inner.Run).Try(); err != nil || calls != 5 {
+		t.Errorf("error should be nil after 5 calls but get %v after %v calls", err, calls)
 	}
 
-	r2 := New().WaitRandom(time.Minute, time.Second)
-	if len(r2.errors) != 1 {
-		t.Error("number of errors should be 1")
+	// errors of each inner run are one error of the outer retry
+	calls, succeedAt = 0, 0
+	err := New().MaxAttemptTimes(2).Func(inner.Run).Try()
+	var merr *multierror.Error
+	if !errors.As(err, &merr) || len(merr.Errors) != 2 || calls != 6 {
+		t.Errorf("error should have 2 inner runs after 6 calls but get %v after %v calls", err, calls)
+	}
+	if !errors.Is(err, errFail) {
+		t.Errorf("error should be %v but get %v", errFail, err)
 	}
+	if _, ok := interface{}(inner).(interface{ Run() error }); !ok {
+		t.Error("retryable should have Run")
+	}
+}
 
-	r3 := New().WaitRandom(time.Duration(-1), time.Duration(-1))
-	if len(r3.errors) != 2 {
-		t.Error("number of errors should be 2")
+func TestNotConfigured(t *testing.T) {
+	// invalid config and missing function are not configured
+	called := false
+	err := New().MaxAttemptTimes(0).Function(func() { called = true }).Try()
+	if !errors.Is(err, ErrNotConfigured) || !errors.Is(err, ErrInvalidMaxAttempts) || called {
+		t.Errorf("error should be %v without calls but get %v", ErrNotConfigured, err)
+	}
+	var merr *multierror.Error
+	if !errors.As(err, &merr) || len(merr.Errors) != 1 {
+		t.Errorf("error should unwrap to init errors but get %v", err)
+	}
+	if err := New().MaxAttemptTimes(3).Try(); !errors.Is(err, ErrNotConfigured) || !errors.Is(err, ErrNoFunctionSpecified) {
+		t.Errorf("error should be %v and %v but get %v", ErrNotConfigured, ErrNoFunctionSpecified, err)
+	}
+
+	// failures of the function are not
+	if err := New().MaxAttemptTimes(2).Func(func() error { return io.EOF }).Try(); !errors.Is(err, io.EOF) || errors.Is(err, ErrNotConfigured) {
+		t.Errorf("error should be %v but get %v", io.EOF, err)
+	}
+	if err := New().MaxDelay(time.Millisecond).Func(func() error {
+		time.Sleep(time.Millisecond * 10)
+		return nil
+	}).Try(); !errors.Is(err, ErrTimeout) || errors.Is(err, ErrNotConfigured) {
+		t.Errorf("error should be %v but get %v", ErrTimeout, err)
 	}
 }
 
-func TestFunction(t *testing.T) {
-	r1 := New().Function(1)
-	if len(r1.errors) != 1 {
-		t.Error("number of errors should be 1")
+func TestMustBuild(t *testing.T) {
+	defer func() {
+		if e := recover(); e == nil {
+			t.Error("should panic")
+		}
+	}()
+
+	if r := New().MaxAttemptTimes(2); r.MustBuild() != r {
+		t.Error("should return the retryable itself")
 	}
+	New().MaxAttemptTimes(-1).MustBuild()
+}
 
-	r2 := New().Function(func(_ int) int { return 1 })
-	if len(r2.errors) != 2 {
-		t.Error("number of errors should be 2")
+func TestMustTry(t *testing.T) {
+	// normal run
+	c := 0
+	if err := New().MaxAttemptTimes(2).Function(func() error {
+		c++
+		return fmt.Errorf("")
+	}).MustTry(); err == nil || c != 2 {
+		t.Errorf("function should fail 2 times but get %v calls with %v", c, err)
 	}
+
+	// misconfiguration
+	defer func() {
+		if e := recover(); e == nil {
+			t.Error("should panic")
+		}
+	}()
+	New().WaitFixed(0).Function(func() {}).MustTry()
 }
 
 func TestTry(t *testing.T) {
@@ -72,8 +1805,8 @@ func TestTry(t *testing.T) {
 	}
 
 	// no function specified
-	errors := multierror.Append(nil, ErrNoFunctionSpecified)
-	if err := New().Try(); err.Error() != errors.Error() {
+	expected := multierror.Append(nil, ErrNoFunctionSpecified)
+	if err := New().Try(); err.Error() != expected.Error() {
 		t.Errorf("error should be no function specified but get %v", err)
 	}
 
@@ -114,7 +1847,7 @@ func TestTry(t *testing.T) {
 		Function(func() {
 			time.Sleep(time.Minute)
 		}).
-		Try(); err != ErrTimeout {
+		Try(); !errors.Is(err, ErrTimeout) {
 		t.Errorf("error should be timeout but get %v", err)
 	}
 
@@ -132,3 +1865,528 @@ func TestTry(t *testing.T) {
 		t.Errorf("error should not be nil")
 	}
 }
+
+func TestTryContext(t *testing.T) {
+	// cancelled before the first attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	if err := New().Function(func() { called = true }).TryContext(ctx); err != context.Canceled {
+		t.Errorf("error should be context canceled but get %v", err)
+	}
+	if called {
+		t.Error("function should not be called")
+	}
+
+	// deadline shorter than the fixed wait
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	if err := New().MaxAttemptTimes(3).
+		WaitFixed(time.Second).
+		Function(func() error { return fmt.Errorf("") }).
+		TryContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("error should be deadline exceeded but get %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*200 {
+		t.Errorf("should return around 50ms but get %v", elapsed)
+	}
+
+	// deadline shorter than the fixed wait with timeout
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start = time.Now()
+	if err := New().MaxAttemptTimes(3).
+		MaxDelay(time.Minute).
+		WaitFixed(time.Second).
+		Function(func() error { return fmt.Errorf("") }).
+		TryContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("error should be deadline exceeded but get %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*200 {
+		t.Errorf("should return around 50ms but get %v", elapsed)
+	}
+}
+
+func TestTryConcurrently(t *testing.T) {
+	var calls int64
+	r := New().MaxAttemptTimes(3).
+		RandSource(rand.NewSource(1)).
+		WaitRandom(time.Microsecond, time.Millisecond).
+		Function(func() error {
+			atomic.AddInt64(&calls, 1)
+			return fmt.Errorf("")
+		})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.Try()
+			if merr, ok := err.(*multierror.Error); !ok || len(merr.Errors) != 3 {
+				t.Errorf("number of errors should be 3 but get %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 150 {
+		t.Errorf("function should be called 150 times but get %v", calls)
+	}
+}
+
+func TestRetryImmediately(t *testing.T) {
+	// zero wait
+	c1 := 0
+	start := time.Now()
+	if err := New().MaxAttemptTimes(3).
+		WaitFixed(time.Minute).
+		Function(func() error {
+			c1++
+			if c1 == 3 {
+				return nil
+			}
+			return fmt.Errorf("rate limited: %w", ErrRetryImmediately)
+		}).
+		Try(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("should not wait but get %v", elapsed)
+	}
+
+	// server specified wait
+	c2 := 0
+	start = time.Now()
+	if err := New().MaxAttemptTimes(3).
+		WaitFixed(time.Minute).
+		Function(func() error {
+			c2++
+			if c2 == 3 {
+				return nil
+			}
+			return &RetryAfterError{Duration: time.Millisecond * 20, Err: fmt.Errorf("rate limited")}
+		}).
+		Try(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*40 || elapsed > time.Second {
+		t.Errorf("should wait around 40ms but get %v", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	errLimited := fmt.Errorf("rate limited")
+	err := RetryAfter(time.Second, errLimited)
+	if !errors.Is(err, errLimited) {
+		t.Errorf("error should wrap %v but get %v", errLimited, err)
+	}
+
+	// override once then resume the configured wait
+	r := New().WaitFixed(time.Minute)
+	if d := r.waitDuration(1, fmt.Errorf("wrapped: %w", err)); d != time.Second {
+		t.Errorf("wait should be 1s but get %v", d)
+	}
+	if d := r.waitDuration(2, errLimited); d != time.Minute {
+		t.Errorf("wait should be 1m but get %v", d)
+	}
+
+	// negative duration is ignored
+	if d := r.waitDuration(1, RetryAfter(-time.Second, errLimited)); d != time.Minute {
+		t.Errorf("wait should be 1m but get %v", d)
+	}
+
+	// override timing
+	c := 0
+	start := time.Now()
+	if err := New().MaxAttemptTimes(2).
+		WaitFixed(time.Minute).
+		Function(func() error {
+			c++
+			if c == 2 {
+				return nil
+			}
+			return RetryAfter(time.Millisecond*50, errLimited)
+		}).
+		Try(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 || elapsed > time.Second {
+		t.Errorf("should wait around 50ms but get %v", elapsed)
+	}
+}
+
+func TestTryWithTimeoutStopsWorker(t *testing.T) {
+	var calls int64
+	if err := New().MaxAttemptTimes(100).
+		MaxDelay(time.Millisecond * 50).
+		WaitFixed(time.Millisecond * 10).
+		Function(func() error {
+			atomic.AddInt64(&calls, 1)
+			return fmt.Errorf("")
+		}).
+		Try(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("error should be timeout but get %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	if n := atomic.LoadInt64(&calls); n >= 20 {
+		t.Errorf("worker should stop after timeout but get %v calls", n)
+	}
+}
+
+func TestTimeoutKeepsErrors(t *testing.T) {
+	err1, err2 := fmt.Errorf("first"), fmt.Errorf("second")
+	c := 0
+	err := New().MaxAttemptTimes(3).
+		MaxDelay(time.Millisecond * 100).
+		Function(func() error {
+			c++
+			switch c {
+			case 1:
+				return err1
+			case 2:
+				return err2
+			}
+			time.Sleep(time.Second)
+			return nil
+		}).
+		Try()
+	for _, e := range []error{err1, err2, ErrTimeout} {
+		if !errors.Is(err, e) {
+			t.Errorf("error should contain %v but get %v", e, err)
+		}
+	}
+	if merr, ok := err.(*multierror.Error); !ok || len(merr.Errors) != 3 {
+		t.Errorf("number of errors should be 3 but get %v", err)
+	}
+}
+
+func TestTryAsync(t *testing.T) {
+	chans := make([]<-chan error, 5)
+	for i := range chans {
+		i := i
+		chans[i] = New().MaxAttemptTimes(2).Function(func() error {
+			if i%2 == 0 {
+				return nil
+			}
+			return fmt.Errorf("")
+		}).TryAsync()
+	}
+
+	for i, ch := range chans {
+		err := <-ch
+		if i%2 == 0 && err != nil {
+			t.Errorf("error of retry %v should be nil but get %v", i, err)
+		}
+		if i%2 == 1 && err == nil {
+			t.Errorf("error of retry %v should not be nil", i)
+		}
+		if _, ok := <-ch; ok {
+			t.Errorf("chan of retry %v should be closed", i)
+		}
+	}
+
+	// cancelled by context
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := New().MaxAttemptTimes(2).
+		WaitFixed(time.Minute).
+		Function(func() error { return fmt.Errorf("") }).
+		TryAsyncContext(ctx)
+	cancel()
+	if err := <-ch; err != context.Canceled {
+		t.Errorf("error should be context canceled but get %v", err)
+	}
+}
+
+func TestAnnotateErrors(t *testing.T) {
+	errFail := fmt.Errorf("fail")
+	for _, annotate := range []bool{false, true} {
+		err := New().MaxAttemptTimes(2).
+			WaitFixed(time.Millisecond * 10).
+			AnnotateErrors(annotate).
+			Function(func() error { return errFail }).
+			Try()
+		merr, ok := err.(*multierror.Error)
+		if !ok || len(merr.Errors) != 2 {
+			t.Fatalf("number of errors should be 2 but get %v", err)
+		}
+		for i, e := range merr.Errors {
+			if !errors.Is(e, errFail) {
+				t.Errorf("error should unwrap to %v but get %v", errFail, e)
+			}
+			if !annotate && e != errFail {
+				t.Errorf("error should be raw but get %v", e)
+			}
+			if prefix := fmt.Sprintf("attempt %v after ", i+1); annotate && !strings.HasPrefix(e.Error(), prefix) {
+				t.Errorf("error should start with %q but get %q", prefix, e.Error())
+			}
+		}
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	err1, err2 := fmt.Errorf("1"), fmt.Errorf("2")
+	c := 0
+	err := New().MaxAttemptTimes(3).
+		MaxDelay(time.Millisecond * 50).
+		JoinErrors(true).
+		Function(func() error {
+			c++
+			switch c {
+			case 1:
+				return err1
+			case 2:
+				return err2
+			}
+			time.Sleep(time.Millisecond * 100)
+			return nil
+		}).
+		Try()
+	if _, ok := err.(*multierror.Error); ok {
+		t.Fatalf("error should not be a multierror but get %T", err)
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != 3 {
+		t.Fatalf("number of errors should be 3 but get %v", err)
+	}
+	for _, target := range []error{err1, err2, ErrTimeout} {
+		if !errors.Is(err, target) {
+			t.Errorf("error should match %v but get %v", target, err)
+		}
+	}
+	if err.Error() != "1\n2\ntimeout error" {
+		t.Errorf("error should list errors by line but get %q", err.Error())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	errFail := fmt.Errorf("fail")
+	// errors before a success are dropped by default
+	for succeedAt, failed := range map[int]int{1: 0, 3: 0, 10: 5} {
+		c := 0
+		r := New().MaxAttemptTimes(5).Function(func() error {
+			c++
+			if c == succeedAt {
+				return nil
+			}
+			return errFail
+		})
+		r.Try()
+		errs := r.Errors()
+		if len(errs) != failed {
+			t.Errorf("number of errors should be %v but get %v", failed, len(errs))
+		}
+		for _, err := range errs {
+			if err != errFail {
+				t.Errorf("error should be %v but get %v", errFail, err)
+			}
+		}
+	}
+
+	// sentinels of the timeout are not included
+	r := New().MaxAttemptTimes(3).MaxDelay(time.Millisecond * 50).Function(func() error {
+		time.Sleep(time.Millisecond * 30)
+		return errFail
+	})
+	if err := r.Try(); !errors.Is(err, ErrTimeout) || len(r.Errors()) != 1 {
+		t.Errorf("number of errors should be 1 but get %v with %v", len(r.Errors()), err)
+	}
+}
+
+func TestCollectErrorsOnSuccess(t *testing.T) {
+	errFail := fmt.Errorf("fail")
+	c := 0
+	r := New().MaxAttemptTimes(5).CollectErrorsOnSuccess(true).Function(func() error {
+		c++
+		if c < 3 {
+			return errFail
+		}
+		return nil
+	})
+	if err := r.Try(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+	errs := r.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("number of errors should be 2 but get %v", len(errs))
+	}
+	for _, err := range errs {
+		if err != errFail {
+			t.Errorf("error should be %v but get %v", errFail, err)
+		}
+	}
+}
+
+func TestTryCounted(t *testing.T) {
+	for succeedAt, expected := range map[int]int{1: 1, 3: 3, 10: 5} {
+		c := 0
+		attempts, err := New().MaxAttemptTimes(5).Function(func() error {
+			c++
+			if c == succeedAt {
+				return nil
+			}
+			return fmt.Errorf("")
+		}).TryCounted()
+		if attempts != expected || (err == nil) != (succeedAt <= 5) {
+			t.Errorf("attempts should be %v but get %v with %v", expected, attempts, err)
+		}
+	}
+
+	// misconfiguration
+	if attempts, err := New().MaxAttemptTimes(-1).TryCounted(); attempts != 0 || err == nil {
+		t.Errorf("attempts should be 0 with error but get %v with %v", attempts, err)
+	}
+}
+
+func TestTryValue(t *testing.T) {
+	c := 0
+	v, err := New().MaxAttemptTimes(3).Function(func() (int, error) {
+		c++
+		if c < 2 {
+			return 0, fmt.Errorf("")
+		}
+		return 42, nil
+	}).TryValue()
+	if err != nil || v.(int) != 42 {
+		t.Errorf("result should be 42 and nil but get %v and %v", v, err)
+	}
+
+	// no output
+	if v, err := New().Function(func() error { return nil }).TryValue(); v != nil || err != nil {
+		t.Errorf("result should be nil and nil but get %v and %v", v, err)
+	}
+
+	// the first of multiple outputs
+	if v, err := New().Function(func() (string, int, error) { return "a", 1, nil }).TryValue(); err != nil || v.(string) != "a" {
+		t.Errorf("result should be a and nil but get %v and %v", v, err)
+	}
+
+	// failure
+	if v, err := New().Function(func() (int, error) { return 1, fmt.Errorf("") }).TryValue(); v != nil || err == nil {
+		t.Errorf("result should be nil and error but get %v and %v", v, err)
+	}
+}
+
+func TestTryResult(t *testing.T) {
+	// zero outputs
+	for _, f := range []interface{}{func() {}, func() error { return nil }, func() bool { return true }} {
+		if results, err := New().Function(f).TryResult(); err != nil || len(results) != 0 {
+			t.Errorf("results should be empty but get %v with %v", results, err)
+		}
+	}
+
+	// one output
+	c := 0
+	results, err := New().MaxAttemptTimes(3).Function(func() (int, error) {
+		c++
+		if c < 2 {
+			return 0, fmt.Errorf("")
+		}
+		return c, nil
+	}).TryResult()
+	if err != nil || len(results) != 1 || results[0].(int) != 2 {
+		t.Errorf("results should be [2] but get %v with %v", results, err)
+	}
+
+	// multiple outputs
+	results, err = New().Function(func() (int, string, error) { return 1, "a", nil }).TryResult()
+	if err != nil || len(results) != 2 || results[0].(int) != 1 || results[1].(string) != "a" {
+		t.Errorf("results should be [1 a] but get %v with %v", results, err)
+	}
+
+	// failure
+	if results, err := New().Function(func() (int, error) { return 1, fmt.Errorf("") }).TryResult(); err == nil || results != nil {
+		t.Errorf("results should be nil with error but get %v with %v", results, err)
+	}
+}
+
+func TestName(t *testing.T) {
+	errFail := fmt.Errorf("fail")
+	err := New().Name("fetch-user").Function(func() error { return errFail }).Try()
+	if !strings.HasPrefix(err.Error(), "retry[fetch-user]: ") || !errors.Is(err, errFail) {
+		t.Errorf("error should be prefixed and wrap %v but get %v", errFail, err)
+	}
+
+	err = New().Name("fetch-user").
+		MaxDelay(time.Millisecond * 10).
+		Function(func() { time.Sleep(time.Second) }).
+		Try()
+	if !strings.HasPrefix(err.Error(), "retry[fetch-user]: ") || !errors.Is(err, ErrTimeout) {
+		t.Errorf("error should be prefixed timeout but get %v", err)
+	}
+
+	if err := New().Name("fetch-user").Function(func() {}).Try(); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	errFail := fmt.Errorf("fail")
+	err := Progress(errFail)
+	if !errors.Is(err, ErrProgress) || !errors.Is(err, errFail) || err.Error() != errFail.Error() {
+		t.Errorf("error should match progress and %v but get %v", errFail, err)
+	}
+
+	var waits []time.Duration
+	c := 0
+	New().MaxAttemptTimes(6).
+		WaitFunc(func(attempt int, _ error) time.Duration { return time.Duration(attempt) * time.Millisecond }).
+		OnRetry(func(a Attempt) { waits = append(waits, a.NextWait) }).
+		Function(func() error {
+			c++
+			if c == 3 {
+				return Progress(errFail)
+			}
+			return errFail
+		}).
+		Try()
+
+	expected := []time.Duration{time.Millisecond, time.Millisecond * 2, time.Millisecond, time.Millisecond * 2, time.Millisecond * 3}
+	if fmt.Sprint(waits) != fmt.Sprint(expected) {
+		t.Errorf("waits should be %v but get %v", expected, waits)
+	}
+}
+
+func TestWaitReusesTimer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a fire not received by anyone does not end the next wait early
+	st := &state{clock: realClock{}, timer: time.NewTimer(0)}
+	time.Sleep(time.Millisecond * 10)
+	start := time.Now()
+	if err := st.wait(ctx, time.Millisecond*50); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Errorf("should wait 50ms but get %v", elapsed)
+	}
+
+	// an interrupted wait does not end the next wait early
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if err := st.wait(cancelled, time.Millisecond); err != context.Canceled {
+		t.Errorf("error should be context canceled but get %v", err)
+	}
+	time.Sleep(time.Millisecond * 10)
+	start = time.Now()
+	if err := st.wait(ctx, time.Millisecond*50); err != nil {
+		t.Errorf("error should be nil but get %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Errorf("should wait 50ms but get %v", elapsed)
+	}
+}
+
+func BenchmarkWait(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := &state{clock: realClock{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		st.wait(ctx, time.Nanosecond)
+	}
+}
@@ -0,0 +1,41 @@
+package retryingtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Now()
+	c := NewFakeClock(start)
+
+	ch := c.After(time.Second)
+	c.Advance(time.Millisecond * 500)
+	select {
+	case <-ch:
+		t.Error("after should not fire before its deadline")
+	default:
+	}
+
+	c.Advance(time.Millisecond * 500)
+	select {
+	case now := <-ch:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Errorf("time should be %v but get %v", start.Add(time.Second), now)
+		}
+	default:
+		t.Error("after should fire at its deadline")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.Sleep(time.Minute)
+		close(done)
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Minute)
+	<-done
+	if !c.Now().Equal(start.Add(time.Minute + time.Second)) {
+		t.Errorf("time should be advanced but get %v", c.Now())
+	}
+}
@@ -0,0 +1,387 @@
+package retrying
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// MaxInterval set max duration of a single wait
+// it is the final clamp of whatever WaitFixed, WaitRandom or other wait strategies compute,
+// while waits requested by the function via ErrRetryImmediately or RetryAfter are not capped
+func (r *Retryable) MaxInterval(d time.Duration) *Retryable {
+	if d <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: must be positive duration", ErrInvalidMaxInterval))
+		return r
+	}
+	r.maxInterval = d
+	return r
+}
+
+// RandSource set source of random waits, a package generator seeded at init is used by default
+func (r *Retryable) RandSource(src rand.Source) *Retryable {
+	if src == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: must not be nil", ErrInvalidRandSource))
+		return r
+	}
+	r.rand = rand.New(&lockedSource{src: src})
+	return r
+}
+
+// WaitExponential set wait as base * multiplier^(attempt-1)
+// it never overflows, huge waits are clamped to MaxInterval if set or to the max duration otherwise
+// it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitExponential(base time.Duration, multiplier float64) *Retryable {
+	errs := len(r.errors)
+	if base <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: base must be positive duration", ErrInvalidWaitExponential))
+	}
+	if multiplier < 1 {
+		r.errors = append(r.errors, fmt.Errorf("%w: multiplier must not be smaller than 1", ErrInvalidWaitExponential))
+	}
+	if len(r.errors) > errs {
+		return r
+	}
+	r.waitStrategy = func(r *Retryable, attempt int, _ error) time.Duration {
+		return exponential(base, multiplier, attempt)
+	}
+	return r
+}
+
+// WaitRandomExponential set wait as a random duration in [0, base * multiplier^(attempt-1)]
+// the exponential ceiling is capped by MaxInterval if set
+// it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitRandomExponential(base time.Duration, multiplier float64) *Retryable {
+	errs := len(r.errors)
+	if base <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: base must be positive duration", ErrInvalidWaitRandomExponential))
+	}
+	if multiplier < 1 {
+		r.errors = append(r.errors, fmt.Errorf("%w: multiplier must not be smaller than 1", ErrInvalidWaitRandomExponential))
+	}
+	if len(r.errors) > errs {
+		return r
+	}
+	r.waitStrategy = func(r *Retryable, attempt int, _ error) time.Duration {
+		ceiling := int64(r.capInterval(exponential(base, multiplier, attempt)))
+		if r.skipJitter(attempt) {
+			return time.Duration(ceiling)
+		}
+		if ceiling < math.MaxInt64 {
+			ceiling++
+		}
+		return time.Duration(r.int63n(ceiling))
+	}
+	return r
+}
+
+// WaitExponentialWithJitterCap set wait as base * multiplier^(attempt-1) plus a random duration in [0, jitterCap]
+// unlike WaitRandomExponential the exponential part is a floor, so waits keep growing with bounded randomness
+// it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitExponentialWithJitterCap(base time.Duration, multiplier float64, jitterCap time.Duration) *Retryable {
+	errs := len(r.errors)
+	if base <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: base must be positive duration", ErrInvalidWaitExponentialWithJitterCap))
+	}
+	if multiplier < 1 {
+		r.errors = append(r.errors, fmt.Errorf("%w: multiplier must not be smaller than 1", ErrInvalidWaitExponentialWithJitterCap))
+	}
+	if jitterCap < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: jitter cap must not be negative duration", ErrInvalidWaitExponentialWithJitterCap))
+	}
+	if len(r.errors) > errs {
+		return r
+	}
+	r.waitStrategy = func(r *Retryable, attempt int, _ error) time.Duration {
+		floor := exponential(base, multiplier, attempt)
+		if jitterCap <= 0 || r.skipJitter(attempt) {
+			return floor
+		}
+		n := int64(jitterCap)
+		if n < math.MaxInt64 {
+			n++
+		}
+		jitter := time.Duration(r.int63n(n))
+		if floor > math.MaxInt64-jitter {
+			return math.MaxInt64
+		}
+		return floor + jitter
+	}
+	return r
+}
+
+// WaitConstantThenBackoff set wait as constant after the first constantAttempts attempts,
+// then as base * multiplier^(n-1) where n counts attempts after them
+// it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitConstantThenBackoff(constant time.Duration, constantAttempts int, base time.Duration, multiplier float64) *Retryable {
+	errs := len(r.errors)
+	if constant < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: constant must not be negative duration", ErrInvalidWaitConstantThenBackoff))
+	}
+	if constantAttempts < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: constant attempts must not be negative", ErrInvalidWaitConstantThenBackoff))
+	}
+	if base <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: base must be positive duration", ErrInvalidWaitConstantThenBackoff))
+	}
+	if multiplier < 1 {
+		r.errors = append(r.errors, fmt.Errorf("%w: multiplier must not be smaller than 1", ErrInvalidWaitConstantThenBackoff))
+	}
+	if len(r.errors) > errs {
+		return r
+	}
+	r.waitStrategy = func(r *Retryable, attempt int, _ error) time.Duration {
+		if attempt <= constantAttempts {
+			return constant
+		}
+		return exponential(base, multiplier, attempt-constantAttempts)
+	}
+	return r
+}
+
+// WaitPolynomial set wait as base * attempt^power, e.g. power 1 grows linearly and 2 quadratically
+// the wait is capped by MaxInterval if set
+// it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitPolynomial(base time.Duration, power float64) *Retryable {
+	errs := len(r.errors)
+	if base <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: base must be positive duration", ErrInvalidWaitPolynomial))
+	}
+	if power < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: power must not be negative", ErrInvalidWaitPolynomial))
+	}
+	if len(r.errors) > errs {
+		return r
+	}
+	r.waitStrategy = func(r *Retryable, attempt int, _ error) time.Duration {
+		return polynomial(base, power, attempt)
+	}
+	return r
+}
+
+// WaitLinear set wait as initial + (attempt-1) * increment
+// the wait is capped by MaxInterval if set
+// it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitLinear(initial, increment time.Duration) *Retryable {
+	errs := len(r.errors)
+	if initial <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: initial must be positive duration", ErrInvalidWaitLinear))
+	}
+	if increment < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: increment must not be negative duration", ErrInvalidWaitLinear))
+	}
+	if len(r.errors) > errs {
+		return r
+	}
+	r.waitStrategy = func(r *Retryable, attempt int, _ error) time.Duration {
+		return linear(initial, increment, attempt)
+	}
+	return r
+}
+
+// WaitWeighted set wait as one of choices picked with probability proportional to its weight
+// picks are drawn from the configured RandSource, it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitWeighted(choices []time.Duration, weights []int) *Retryable {
+	if len(choices) == 0 || len(choices) != len(weights) {
+		r.errors = append(r.errors, fmt.Errorf("%w: choices and weights must be non-empty with equal lengths", ErrInvalidWaitWeighted))
+		return r
+	}
+	var total int64
+	for i := range choices {
+		if choices[i] < 0 {
+			r.errors = append(r.errors, fmt.Errorf("%w: choices must not be negative durations", ErrInvalidWaitWeighted))
+			return r
+		}
+		if weights[i] <= 0 {
+			r.errors = append(r.errors, fmt.Errorf("%w: weights must be positive integers", ErrInvalidWaitWeighted))
+			return r
+		}
+		total += int64(weights[i])
+	}
+
+	choices = append([]time.Duration(nil), choices...)
+	weights = append([]int(nil), weights...)
+	r.waitStrategy = func(r *Retryable, _ int, _ error) time.Duration {
+		n := r.int63n(total)
+		for i, w := range weights {
+			if n < int64(w) {
+				return choices[i]
+			}
+			n -= int64(w)
+		}
+		return choices[len(choices)-1]
+	}
+	return r
+}
+
+// WaitFixedJitter set wait as a random duration in [base-jitter, base+jitter] which is never negative
+// it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitFixedJitter(base, jitter time.Duration) *Retryable {
+	errs := len(r.errors)
+	if base <= 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: base must be positive duration", ErrInvalidWaitFixedJitter))
+	}
+	if jitter < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: jitter must not be negative duration", ErrInvalidWaitFixedJitter))
+	}
+	if len(r.errors) > errs {
+		return r
+	}
+	r.waitStrategy = func(r *Retryable, attempt int, _ error) time.Duration {
+		if r.skipJitter(attempt) {
+			return base
+		}
+		// the range is clamped to non-negative durations before drawing so that its span never overflows
+		lo, hi := int64(base-jitter), int64(base)
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > math.MaxInt64-int64(jitter) {
+			hi = math.MaxInt64
+		} else {
+			hi += int64(jitter)
+		}
+		span := hi - lo
+		if span < math.MaxInt64 {
+			span++
+		}
+		return time.Duration(lo + r.int63n(span))
+	}
+	return r
+}
+
+// JitterFirst set whether jitter of WaitRandomExponential, WaitExponentialWithJitterCap and WaitFixedJitter
+// applies to the first wait, it does by default so that clients failing at the same instant do not retry in sync
+// without it the first wait is the exponential ceiling, the exponential floor or the base respectively
+func (r *Retryable) JitterFirst(jitter bool) *Retryable {
+	r.noJitterFirst = !jitter
+	return r
+}
+
+// WaitFunc set function computing wait from the attempt which starts from 1 and the error it returned
+// it takes precedence over WaitFixed and WaitRandom
+func (r *Retryable) WaitFunc(f func(attempt int, lastErr error) time.Duration) *Retryable {
+	if f == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: must not be nil", ErrInvalidWaitFunc))
+		return r
+	}
+	r.waitStrategy = func(_ *Retryable, attempt int, err error) time.Duration {
+		return f(attempt, err)
+	}
+	return r
+}
+
+// StartAttempt continue the backoff sequence as if n attempts had already failed, e.g. after a restart
+// the first wait is computed for attempt n+1, MaxAttemptTimes still counts attempts of the try only
+func (r *Retryable) StartAttempt(n int) *Retryable {
+	if n < 0 {
+		r.errors = append(r.errors, fmt.Errorf("%w: must not be negative integer", ErrInvalidStartAttempt))
+		return r
+	}
+	r.startAttempt = n
+	return r
+}
+
+// WaitModifier set function adjusting the wait computed by the configured strategy, e.g. from observed load
+// its result is clamped to be non-negative and capped by MaxInterval, waits requested by the function are not modified
+func (r *Retryable) WaitModifier(f func(attempt int, computed time.Duration) time.Duration) *Retryable {
+	if f == nil {
+		r.errors = append(r.errors, fmt.Errorf("%w: must not be nil", ErrInvalidWaitModifier))
+		return r
+	}
+	r.waitModifier = f
+	return r
+}
+
+// Schedule return waits after each of the first n attempts without calling the function or sleeping
+// random waits are drawn from the configured RandSource, so a seeded source gives reproducible schedules
+func (r *Retryable) Schedule(n int) []time.Duration {
+	var schedule []time.Duration
+	for attempt := 1; attempt <= n; attempt++ {
+		schedule = append(schedule, r.waitDuration(attempt+r.startAttempt, nil))
+	}
+	return schedule
+}
+
+// helpers
+//
+// lockedSource make a rand.Source safe for concurrent use
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// packageRand is used unless RandSource is set, it is seeded at init so that jitter differs across processes
+var packageRand = rand.New(&lockedSource{src: rand.NewSource(newSeed())})
+
+func newSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+func (r *Retryable) int63n(n int64) int64 {
+	if r.rand != nil {
+		return r.rand.Int63n(n)
+	}
+	return packageRand.Int63n(n)
+}
+
+func (r *Retryable) capInterval(d time.Duration) time.Duration {
+	if r.maxInterval > 0 && d > r.maxInterval {
+		return r.maxInterval
+	}
+	return d
+}
+
+// skipJitter report whether the wait after attempt is computed without jitter
+func (r *Retryable) skipJitter(attempt int) bool {
+	return attempt == 1 && r.noJitterFirst
+}
+
+// exponential compute base * multiplier^(attempt-1) without overflowing time.Duration
+func exponential(base time.Duration, multiplier float64, attempt int) time.Duration {
+	d := float64(base) * math.Pow(multiplier, float64(attempt-1))
+	if d >= math.MaxInt64 || math.IsNaN(d) {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// linear compute initial + (attempt-1) * increment without overflowing time.Duration
+func linear(initial, increment time.Duration, attempt int) time.Duration {
+	if attempt <= 1 || increment == 0 {
+		return initial
+	}
+	if int64(attempt-1) > (math.MaxInt64-int64(initial))/int64(increment) {
+		return math.MaxInt64
+	}
+	return initial + time.Duration(attempt-1)*increment
+}
+
+// polynomial compute base * attempt^power without overflowing time.Duration
+func polynomial(base time.Duration, power float64, attempt int) time.Duration {
+	d := float64(base) * math.Pow(float64(attempt), power)
+	if d >= math.MaxInt64 || math.IsNaN(d) {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
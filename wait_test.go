@@ -0,0 +1,533 @@
+package retrying
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMaxInterval(t *testing.T) {
+	r := New().MaxInterval(time.Duration(0))
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidMaxInterval) {
+		t.Errorf("error should be %v but get %v", ErrInvalidMaxInterval, r.errors[0])
+	}
+}
+
+func TestMaxIntervalClamp(t *testing.T) {
+	r := New().RandSource(rand.NewSource(1)).WaitRandom(time.Second, time.Second*10).MaxInterval(time.Second * 3)
+	for i, d := range r.Schedule(100) {
+		if d < time.Second || d > time.Second*3 {
+			t.Errorf("wait %v should be in [1s, 3s] but get %v", i, d)
+		}
+	}
+
+	if d := New().WaitFixed(time.Minute).MaxInterval(time.Second).waitDuration(1, nil); d != time.Second {
+		t.Errorf("wait should be 1s but get %v", d)
+	}
+
+	// waits requested by the function are not capped
+	if d := New().MaxInterval(time.Second).waitDuration(1, RetryAfter(time.Minute, nil)); d != time.Minute {
+		t.Errorf("wait should be 1m but get %v", d)
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	r := New().RandSource(nil)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidRandSource) {
+		t.Errorf("error should be %v but get %v", ErrInvalidRandSource, r.errors[0])
+	}
+
+	// same seed produces same waits
+	r1 := New().RandSource(rand.NewSource(1)).WaitRandom(time.Second, time.Minute)
+	r2 := New().RandSource(rand.NewSource(1)).WaitRandom(time.Second, time.Minute)
+	for attempt := 1; attempt <= 10; attempt++ {
+		if d1, d2 := r1.waitDuration(attempt, nil), r2.waitDuration(attempt, nil); d1 != d2 {
+			t.Errorf("waits should be equal but get %v and %v", d1, d2)
+		}
+	}
+}
+
+func TestPackageRand(t *testing.T) {
+	s1 := New().WaitRandom(0, time.Hour).Schedule(3)
+	s2 := New().WaitRandom(0, time.Hour).Schedule(3)
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return
+		}
+	}
+	t.Errorf("waits of fresh retryables should differ but get %v and %v", s1, s2)
+}
+
+func TestWaitExponential(t *testing.T) {
+	r1 := New().WaitExponential(time.Duration(-1), 0.5)
+	if len(r1.errors) != 2 {
+		t.Error("number of errors should be 2")
+	}
+	for _, err := range r1.errors {
+		if !errors.Is(err, ErrInvalidWaitExponential) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitExponential, err)
+		}
+	}
+
+	ms := time.Millisecond
+	expected := []time.Duration{10 * ms, 20 * ms, 40 * ms, 80 * ms}
+	s := New().WaitExponential(10*ms, 2).Schedule(len(expected))
+	for i := range expected {
+		if s[i] != expected[i] {
+			t.Errorf("wait %v should be %v but get %v", i, expected[i], s[i])
+		}
+	}
+
+	// enough attempts to overflow stay clamped and positive
+	r2 := New().WaitExponential(time.Second, 2)
+	r3 := New().WaitExponential(time.Second, 2).MaxInterval(time.Hour)
+	for _, attempt := range []int{63, 64, 100, 1100, 1 << 20} {
+		if d := r2.waitDuration(attempt, nil); d != math.MaxInt64 {
+			t.Errorf("wait of attempt %v should be %v but get %v", attempt, time.Duration(math.MaxInt64), d)
+		}
+		if d := r3.waitDuration(attempt, nil); d != time.Hour {
+			t.Errorf("wait of attempt %v should be 1h but get %v", attempt, d)
+		}
+	}
+}
+
+func TestWaitRandomExponential(t *testing.T) {
+	r1 := New().WaitRandomExponential(time.Duration(0), 2)
+	if len(r1.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+
+	r2 := New().WaitRandomExponential(time.Duration(-1), 0.5)
+	if len(r2.errors) != 2 {
+		t.Error("number of errors should be 2")
+	}
+	for _, err := range append(r1.errors, r2.errors...) {
+		if !errors.Is(err, ErrInvalidWaitRandomExponential) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitRandomExponential, err)
+		}
+	}
+
+	// waits stay within the growing ceiling
+	base := time.Millisecond * 10
+	r3 := New().RandSource(rand.NewSource(1)).WaitRandomExponential(base, 2)
+	for attempt := 1; attempt <= 10; attempt++ {
+		ceiling := base << uint(attempt-1)
+		if d := r3.waitDuration(attempt, nil); d < 0 || d > ceiling {
+			t.Errorf("wait of attempt %v should be in [0, %v] but get %v", attempt, ceiling, d)
+		}
+	}
+
+	// waits are capped by max interval
+	r4 := New().RandSource(rand.NewSource(1)).WaitRandomExponential(base, 2).MaxInterval(time.Millisecond * 50)
+	for attempt := 1; attempt <= 100; attempt++ {
+		if d := r4.waitDuration(attempt, nil); d < 0 || d > time.Millisecond*50 {
+			t.Errorf("wait of attempt %v should be in [0, 50ms] but get %v", attempt, d)
+		}
+	}
+}
+
+func TestWaitExponentialWithJitterCap(t *testing.T) {
+	r1 := New().WaitExponentialWithJitterCap(time.Duration(0), 2, time.Second)
+	if len(r1.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+
+	r2 := New().WaitExponentialWithJitterCap(time.Duration(-1), 0.5, -time.Second)
+	if len(r2.errors) != 3 {
+		t.Error("number of errors should be 3")
+	}
+	for _, err := range append(r1.errors, r2.errors...) {
+		if !errors.Is(err, ErrInvalidWaitExponentialWithJitterCap) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitExponentialWithJitterCap, err)
+		}
+	}
+
+	// waits stay between the exponential floor and the floor plus jitter cap
+	base, jitterCap := time.Millisecond*10, time.Millisecond*5
+	r3 := New().RandSource(rand.NewSource(1)).WaitExponentialWithJitterCap(base, 2, jitterCap)
+	for attempt := 1; attempt <= 10; attempt++ {
+		floor := base << uint(attempt-1)
+		if d := r3.waitDuration(attempt, nil); d < floor || d > floor+jitterCap {
+			t.Errorf("wait of attempt %v should be in [%v, %v] but get %v", attempt, floor, floor+jitterCap, d)
+		}
+	}
+
+	// no jitter without cap
+	r4 := New().WaitExponentialWithJitterCap(base, 2, 0)
+	if d := r4.waitDuration(3, nil); d != base*4 {
+		t.Errorf("wait should be %v but get %v", base*4, d)
+	}
+
+	// huge floors never overflow
+	r5 := New().WaitExponentialWithJitterCap(base, 2, jitterCap)
+	if d := r5.waitDuration(100, nil); d != math.MaxInt64 {
+		t.Errorf("wait should be %v but get %v", time.Duration(math.MaxInt64), d)
+	}
+
+	// nor does the largest jitter cap
+	r6 := New().WaitExponentialWithJitterCap(base, 2, math.MaxInt64)
+	if d := r6.Schedule(1)[0]; d < base {
+		t.Errorf("wait should not be smaller than %v but get %v", base, d)
+	}
+}
+
+func TestWaitConstantThenBackoff(t *testing.T) {
+	r1 := New().WaitConstantThenBackoff(-1, -1, 0, 0.5)
+	if len(r1.errors) != 4 {
+		t.Error("number of errors should be 4")
+	}
+	for _, err := range r1.errors {
+		if !errors.Is(err, ErrInvalidWaitConstantThenBackoff) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitConstantThenBackoff, err)
+		}
+	}
+
+	// crosses over after the constant attempts
+	ms := time.Millisecond
+	expected := []time.Duration{10 * ms, 10 * ms, 100 * ms, 200 * ms, 400 * ms}
+	s := New().WaitConstantThenBackoff(10*ms, 2, 100*ms, 2).Schedule(5)
+	for i := range expected {
+		if s[i] != expected[i] {
+			t.Errorf("wait %v should be %v but get %v", i, expected[i], s[i])
+		}
+	}
+
+	// backoff from the first attempt
+	if d := New().WaitConstantThenBackoff(10*ms, 0, 100*ms, 2).waitDuration(1, nil); d != 100*ms {
+		t.Errorf("wait should be 100ms but get %v", d)
+	}
+}
+
+func TestWaitPolynomial(t *testing.T) {
+	r1 := New().WaitPolynomial(0, -1)
+	if len(r1.errors) != 2 {
+		t.Error("number of errors should be 2")
+	}
+	for _, err := range r1.errors {
+		if !errors.Is(err, ErrInvalidWaitPolynomial) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitPolynomial, err)
+		}
+	}
+
+	ms := time.Millisecond
+	cases := map[float64][]time.Duration{
+		0: {10 * ms, 10 * ms, 10 * ms, 10 * ms},
+		1: {10 * ms, 20 * ms, 30 * ms, 40 * ms},
+		2: {10 * ms, 40 * ms, 90 * ms, 160 * ms},
+	}
+	for power, expected := range cases {
+		s := New().WaitPolynomial(10*ms, power).Schedule(len(expected))
+		for i := range expected {
+			if s[i] != expected[i] {
+				t.Errorf("wait %v of power %v should be %v but get %v", i, power, expected[i], s[i])
+			}
+		}
+	}
+
+	// waits are capped by max interval and never overflow
+	if d := New().WaitPolynomial(10*ms, 2).MaxInterval(50*ms).waitDuration(3, nil); d != 50*ms {
+		t.Errorf("wait should be 50ms but get %v", d)
+	}
+	if d := New().WaitPolynomial(time.Hour, 100).waitDuration(100, nil); d != math.MaxInt64 {
+		t.Errorf("wait should be %v but get %v", time.Duration(math.MaxInt64), d)
+	}
+}
+
+func TestWaitLinear(t *testing.T) {
+	r1 := New().WaitLinear(0, -1)
+	if len(r1.errors) != 2 {
+		t.Error("number of errors should be 2")
+	}
+	for _, err := range r1.errors {
+		if !errors.Is(err, ErrInvalidWaitLinear) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitLinear, err)
+		}
+	}
+
+	ms := time.Millisecond
+	cases := map[time.Duration][]time.Duration{
+		0:       {10 * ms, 10 * ms, 10 * ms, 10 * ms},
+		5 * ms:  {10 * ms, 15 * ms, 20 * ms, 25 * ms},
+		20 * ms: {10 * ms, 30 * ms, 50 * ms, 70 * ms},
+	}
+	for increment, expected := range cases {
+		s := New().WaitLinear(10*ms, increment).Schedule(len(expected))
+		for i := range expected {
+			if s[i] != expected[i] {
+				t.Errorf("wait %v of increment %v should be %v but get %v", i, increment, expected[i], s[i])
+			}
+		}
+	}
+
+	// waits are capped by max interval and never overflow
+	s := New().WaitLinear(10*ms, 20*ms).MaxInterval(40 * ms).Schedule(4)
+	for i, expected := range []time.Duration{10 * ms, 30 * ms, 40 * ms, 40 * ms} {
+		if s[i] != expected {
+			t.Errorf("wait %v should be %v but get %v", i, expected, s[i])
+		}
+	}
+	if d := New().WaitLinear(time.Hour, time.Hour).waitDuration(math.MaxInt32, nil); d != math.MaxInt64 {
+		t.Errorf("wait should be %v but get %v", time.Duration(math.MaxInt64), d)
+	}
+}
+
+func TestWaitWeighted(t *testing.T) {
+	invalid := []struct {
+		choices []time.Duration
+		weights []int
+	}{
+		{nil, nil},
+		{[]time.Duration{time.Second}, []int{1, 2}},
+		{[]time.Duration{-time.Second}, []int{1}},
+		{[]time.Duration{time.Second}, []int{0}},
+	}
+	for _, c := range invalid {
+		r := New().WaitWeighted(c.choices, c.weights)
+		if len(r.errors) != 1 {
+			t.Error("number of errors should be 1")
+		}
+		if !errors.Is(r.errors[0], ErrInvalidWaitWeighted) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitWeighted, r.errors[0])
+		}
+	}
+
+	// frequencies follow the weights
+	choices := []time.Duration{0, time.Millisecond, time.Second}
+	weights := []int{1, 3, 6}
+	counts := map[time.Duration]int{}
+	for _, d := range New().RandSource(rand.NewSource(1)).WaitWeighted(choices, weights).Schedule(10000) {
+		counts[d]++
+	}
+	for i, d := range choices {
+		expected := weights[i] * 1000
+		if counts[d] < expected*9/10 || counts[d] > expected*11/10 {
+			t.Errorf("%v should be picked about %v times but get %v", d, expected, counts[d])
+		}
+	}
+}
+
+func TestJitterFirst(t *testing.T) {
+	ms := time.Millisecond
+	strategies := map[string]struct {
+		r     func() *Retryable
+		fixed time.Duration
+	}{
+		"random exponential": {func() *Retryable { return New().WaitRandomExponential(100*ms, 2) }, 100 * ms},
+		"jitter cap":         {func() *Retryable { return New().WaitExponentialWithJitterCap(100*ms, 2, 100*ms) }, 100 * ms},
+		"fixed jitter":       {func() *Retryable { return New().WaitFixedJitter(100*ms, 50*ms) }, 100 * ms},
+	}
+	for name, s := range strategies {
+		// the first wait is randomized by default
+		seen := map[time.Duration]bool{}
+		for seed := int64(1); seed <= 10; seed++ {
+			seen[s.r().RandSource(rand.NewSource(seed)).Schedule(1)[0]] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("first wait of %v should be randomized but get %v", name, seen)
+		}
+
+		// without jitter first only the first wait is fixed
+		seen = map[time.Duration]bool{}
+		for seed := int64(1); seed <= 10; seed++ {
+			schedule := s.r().RandSource(rand.NewSource(seed)).JitterFirst(false).Schedule(2)
+			if schedule[0] != s.fixed {
+				t.Errorf("first wait of %v should be %v but get %v", name, s.fixed, schedule[0])
+			}
+			seen[schedule[1]] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("second wait of %v should be randomized but get %v", name, seen)
+		}
+	}
+}
+
+func TestWaitFunc(t *testing.T) {
+	r1 := New().WaitFunc(nil)
+	if len(r1.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r1.errors[0], ErrInvalidWaitFunc) {
+		t.Errorf("error should be %v but get %v", ErrInvalidWaitFunc, r1.errors[0])
+	}
+
+	errSlow := errors.New("slow down")
+	r2 := New().WaitFixed(time.Minute).WaitFunc(func(attempt int, lastErr error) time.Duration {
+		d := time.Duration(attempt) * time.Millisecond
+		if errors.Is(lastErr, errSlow) {
+			d *= 10
+		}
+		return d
+	})
+	cases := []struct {
+		attempt  int
+		err      error
+		expected time.Duration
+	}{
+		{1, errors.New(""), time.Millisecond},
+		{2, errors.New(""), time.Millisecond * 2},
+		{1, errSlow, time.Millisecond * 10},
+		{3, errSlow, time.Millisecond * 30},
+	}
+	for _, c := range cases {
+		if d := r2.waitDuration(c.attempt, c.err); d != c.expected {
+			t.Errorf("wait of attempt %v with %v should be %v but get %v", c.attempt, c.err, c.expected, d)
+		}
+	}
+}
+
+func TestWaitModifier(t *testing.T) {
+	r1 := New().WaitModifier(nil)
+	if len(r1.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r1.errors[0], ErrInvalidWaitModifier) {
+		t.Errorf("error should be %v but get %v", ErrInvalidWaitModifier, r1.errors[0])
+	}
+
+	ms := time.Millisecond
+	double := func(_ int, d time.Duration) time.Duration { return d * 2 }
+	if d := New().WaitFixed(10*ms).WaitModifier(double).waitDuration(1, nil); d != 20*ms {
+		t.Errorf("wait should be 20ms but get %v", d)
+	}
+	if d := New().WaitPolynomial(10*ms, 1).WaitModifier(double).waitDuration(3, nil); d != 60*ms {
+		t.Errorf("wait should be 60ms but get %v", d)
+	}
+
+	// clamped to [0, max interval]
+	if d := New().WaitFixed(10*ms).WaitModifier(double).MaxInterval(15*ms).waitDuration(1, nil); d != 15*ms {
+		t.Errorf("wait should be 15ms but get %v", d)
+	}
+	negative := func(int, time.Duration) time.Duration { return -time.Second }
+	if d := New().WaitFixed(10*ms).WaitModifier(negative).waitDuration(1, nil); d != 0 {
+		t.Errorf("wait should be 0 but get %v", d)
+	}
+
+	// waits requested by the function are kept
+	if d := New().WaitModifier(double).waitDuration(1, RetryAfter(time.Second, nil)); d != time.Second {
+		t.Errorf("wait should be 1s but get %v", d)
+	}
+
+	// the modified wait is slept
+	var slept []time.Duration
+	defer func(s func(time.Duration)) { sleep = s }(sleep)
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	New().MaxAttemptTimes(3).
+		WaitFixed(10 * ms).
+		WaitModifier(func(attempt int, d time.Duration) time.Duration { return d * time.Duration(attempt) }).
+		Function(func() error { return ErrReturnedFalse }).
+		Try()
+	if len(slept) != 2 || slept[0] != 10*ms || slept[1] != 20*ms {
+		t.Errorf("waits should be [10ms 20ms] but get %v", slept)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	if s := New().Schedule(0); len(s) != 0 {
+		t.Errorf("schedule should be empty but get %v", s)
+	}
+
+	// fixed
+	for i, d := range New().WaitFixed(time.Second).Schedule(3) {
+		if d != time.Second {
+			t.Errorf("wait %v should be 1s but get %v", i, d)
+		}
+	}
+
+	// seeded random
+	s1 := New().RandSource(rand.NewSource(1)).WaitRandomExponential(time.Second, 2).Schedule(5)
+	s2 := New().RandSource(rand.NewSource(1)).WaitRandomExponential(time.Second, 2).Schedule(5)
+	if len(s1) != 5 || len(s2) != 5 {
+		t.Errorf("length of schedules should be 5 but get %v and %v", len(s1), len(s2))
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			t.Errorf("wait %v should be equal but get %v and %v", i, s1[i], s2[i])
+		}
+	}
+}
+
+func TestStartAttempt(t *testing.T) {
+	r := New().StartAttempt(-1)
+	if len(r.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+	if !errors.Is(r.errors[0], ErrInvalidStartAttempt) {
+		t.Errorf("error should be %v but get %v", ErrInvalidStartAttempt, r.errors[0])
+	}
+
+	// the schedule continues from attempt n+1
+	full := New().WaitExponentialWithJitterCap(time.Millisecond, 2, 0).Schedule(6)
+	resumed := New().WaitExponentialWithJitterCap(time.Millisecond, 2, 0).StartAttempt(3).Schedule(3)
+	for i := range resumed {
+		if resumed[i] != full[i+3] {
+			t.Errorf("wait %v should be %v but get %v", i, full[i+3], resumed[i])
+		}
+	}
+
+	// the try waits from attempt n+1 too
+	var waits []time.Duration
+	New().MaxAttemptTimes(2).
+		WaitExponentialWithJitterCap(time.Millisecond, 2, 0).
+		StartAttempt(3).
+		OnRetry(func(a Attempt) { waits = append(waits, a.NextWait) }).
+		Function(func() error { return ErrReturnedFalse }).
+		Try()
+	if len(waits) != 1 || waits[0] != full[3] {
+		t.Errorf("waits should be [%v] but get %v", full[3], waits)
+	}
+}
+
+func TestWaitFixedJitter(t *testing.T) {
+	r1 := New().WaitFixedJitter(time.Duration(0), time.Second)
+	if len(r1.errors) != 1 {
+		t.Error("number of errors should be 1")
+	}
+
+	r2 := New().WaitFixedJitter(time.Duration(0), time.Duration(-1))
+	if len(r2.errors) != 2 {
+		t.Error("number of errors should be 2")
+	}
+	for _, err := range append(r1.errors, r2.errors...) {
+		if !errors.Is(err, ErrInvalidWaitFixedJitter) {
+			t.Errorf("error should be %v but get %v", ErrInvalidWaitFixedJitter, err)
+		}
+	}
+
+	// waits stay within the jitter range
+	r3 := New().RandSource(rand.NewSource(1)).WaitFixedJitter(time.Second, time.Millisecond*100)
+	for i, d := range r3.Schedule(100) {
+		if d < time.Millisecond*900 || d > time.Millisecond*1100 {
+			t.Errorf("wait %v should be in [900ms, 1.1s] but get %v", i, d)
+		}
+	}
+
+	// waits are clamped to zero
+	r4 := New().RandSource(rand.NewSource(1)).WaitFixedJitter(time.Millisecond, time.Second)
+	for i, d := range r4.Schedule(100) {
+		if d < 0 || d > time.Second+time.Millisecond {
+			t.Errorf("wait %v should be in [0, 1.001s] but get %v", i, d)
+		}
+	}
+
+	// no jitter
+	if d := New().WaitFixedJitter(time.Second, 0).waitDuration(1, nil); d != time.Second {
+		t.Errorf("wait should be 1s but get %v", d)
+	}
+
+	// huge jitters never overflow
+	for _, jitter := range []time.Duration{math.MaxInt64/2 + 1, math.MaxInt64} {
+		for i, d := range New().RandSource(rand.NewSource(1)).WaitFixedJitter(time.Second, jitter).Schedule(10) {
+			if d < 0 {
+				t.Errorf("wait %v should not be negative but get %v", i, d)
+			}
+		}
+	}
+}